@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -10,6 +12,7 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,10 +20,20 @@ type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
-type UsherAPI struct{}
+const (
+	DefaultAPIURL   = "https://api.twitch.tv"
+	DefaultUsherURL = "https://usher.twitch.tv"
+)
+
+var ErrBadBaseURL = errors.New("Base URL must be absolute")
+
+type UsherAPI struct {
+	base *url.URL
+}
 
 type TwitchAPI struct {
 	httpClient HTTPClient
+	base       *url.URL
 }
 
 type TokenType string
@@ -47,6 +60,7 @@ type Channel struct {
 type Stream struct {
 	ID        int64     `json:"_id"`
 	Game      string    `json:"game"`
+	Viewers   int       `json:"viewers"`
 	CreatedAt time.Time `json:"created_at"`
 	Data      struct {
 		Name   string `json:"display_name"`
@@ -54,6 +68,18 @@ type Stream struct {
 	} `json:"channel"`
 }
 
+type Video struct {
+	ID         string    `json:"_id"`
+	Title      string    `json:"title"`
+	Game       string    `json:"game"`
+	Length     int       `json:"length"`
+	RecordedAt time.Time `json:"recorded_at"`
+	Channel    struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	} `json:"channel"`
+}
+
 func (tok Token) Values() (u url.Values) {
 	u = url.Values{}
 	u.Add("sig", tok.Sig)
@@ -77,42 +103,62 @@ func mustGet(u *url.URL) *http.Request {
 	return mustReq("GET", u, nil)
 }
 
+func (api TwitchAPI) get(ctx context.Context, u *url.URL, v interface{}) error {
+	res, err := Limiter.do(ctx, api.httpClient, mustGet(u).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := CheckResponse(res); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(res.Body)
+	return decoder.Decode(v)
+}
+
 func (api TwitchAPI) Token(t TokenType, value string) (token Token, err error) {
+	return api.TokenContext(context.Background(), t, value)
+}
+
+func (api TwitchAPI) TokenContext(ctx context.Context, t TokenType, value string) (token Token, err error) {
 	var u *url.URL
 	if t == TokenLive {
 		u = api.TokenURL("channels", value, nil)
 	} else {
 		u = api.TokenURL("vods", value, nil)
 	}
-	res, err := api.httpClient.Do(mustGet(u))
-	if err != nil {
-		return token, err
-	}
-	defer res.Body.Close()
-	decoder := json.NewDecoder(res.Body)
-	if err := decoder.Decode(&token); err != nil {
-		return token, err
-	}
-	return token, nil
+	err = api.get(ctx, u, &token)
+	return token, err
 }
 
 func (api TwitchAPI) Channel(name string) (channel Channel, err error) {
+	return api.ChannelContext(context.Background(), name)
+}
+
+func (api TwitchAPI) ChannelContext(ctx context.Context, name string) (channel Channel, err error) {
 	endpoint := filepath.Join("kraken", "streams", name)
 	u := api.URL(endpoint, nil)
-	res, err := api.httpClient.Do(mustGet(u))
-	if err != nil {
-		return channel, err
-	}
-	defer res.Body.Close()
-	decoder := json.NewDecoder(res.Body)
-	if err := decoder.Decode(&channel); err != nil {
-		return channel, err
-	}
-	return channel, nil
+	err = api.get(ctx, u, &channel)
+	return channel, err
+}
+
+func (api TwitchAPI) Video(id string) (video Video, err error) {
+	return api.VideoContext(context.Background(), id)
+}
+
+func (api TwitchAPI) VideoContext(ctx context.Context, id string) (video Video, err error) {
+	endpoint := path.Join("kraken", "videos", "v"+strings.TrimPrefix(id, "v"))
+	u := api.URL(endpoint, nil)
+	err = api.get(ctx, u, &video)
+	return video, err
 }
 
 func (api TwitchAPI) IsLive(channelName string) (live bool, err error) {
-	c, err := api.Channel(channelName)
+	return api.IsLiveContext(context.Background(), channelName)
+}
+
+func (api TwitchAPI) IsLiveContext(ctx context.Context, channelName string) (live bool, err error) {
+	c, err := api.ChannelContext(ctx, channelName)
 	if err != nil {
 		return false, err
 	}
@@ -122,11 +168,54 @@ func (api TwitchAPI) IsLive(channelName string) (live bool, err error) {
 	return live, nil
 }
 
+func parseBaseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, ErrBadBaseURL
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
+
+func mustBaseURL(raw string) *url.URL {
+	u, err := parseBaseURL(raw)
+	must(err)
+	return u
+}
+
+// resolve returns a copy of base with endpoint appended to its path,
+// falling back to def when base is not set.
+func resolve(base *url.URL, def, endpoint string) *url.URL {
+	if base == nil {
+		base = mustBaseURL(def)
+	}
+	u := *base
+	u.Path = path.Join(u.Path, endpoint)
+	return &u
+}
+
+func NewTwitchAPI(client HTTPClient, baseURL string) (api TwitchAPI, err error) {
+	api.httpClient = client
+	api.base, err = parseBaseURL(baseURL)
+	return api, err
+}
+
+func NewUsherAPI(baseURL string) (api UsherAPI, err error) {
+	api.base, err = parseBaseURL(baseURL)
+	return api, err
+}
+
+// Helix returns a Helix client that shares the base URL and HTTP client.
+func (api TwitchAPI) Helix(clientID string) Helix {
+	return Helix{httpClient: api.httpClient, ClientID: clientID, base: api.base}
+}
+
 func (api TwitchAPI) URL(endpoint string, params url.Values) (u *url.URL) {
-	u = new(url.URL)
-	u.Path = fmt.Sprintf("%s.json", endpoint)
-	u.Host = "api.twitch.tv"
-	u.Scheme = "https"
+	u = resolve(api.base, DefaultAPIURL, fmt.Sprintf("%s.json", endpoint))
 	values := u.Query()
 	for k, v := range params {
 		values[k] = v
@@ -144,10 +233,7 @@ func randInt(max int) int {
 }
 
 func (api UsherAPI) URL(endpoint string, params url.Values) (u *url.URL) {
-	u = new(url.URL)
-	u.Path = endpoint
-	u.Host = "usher.twitch.tv"
-	u.Scheme = "http"
+	u = resolve(api.base, DefaultUsherURL, endpoint)
 	values := u.Query()
 	values.Add("player", "twitchweb")
 	values.Add("p", strconv.Itoa(randInt(999999)))
@@ -170,6 +256,6 @@ func (api UsherAPI) Video(video_id string, params url.Values) (u *url.URL) {
 }
 
 var (
-	Usher = UsherAPI{}
-	API   = TwitchAPI{http.DefaultClient}
+	Usher = UsherAPI{mustBaseURL(DefaultUsherURL)}
+	API   = TwitchAPI{http.DefaultClient, mustBaseURL(DefaultAPIURL)}
 )
@@ -4,10 +4,13 @@ import (
 	"testing"
 
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -83,3 +86,87 @@ func TestUsher(t *testing.T) {
 		})
 	})
 }
+
+func TestContext(t *testing.T) {
+	Convey("Context", t, func() {
+		m := &MockHTTPClient{}
+		m.callback = func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(`{"stream": null}`, http.StatusOK), nil
+		}
+		client := TwitchAPI{httpClient: m}
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := client.ChannelContext(ctx, "test")
+		So(err, ShouldBeNil)
+		cancel()
+		_, err = client.ChannelContext(ctx, "test")
+		So(err, ShouldEqual, context.Canceled)
+		_, err = client.TokenContext(ctx, TokenLive, "test")
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
+
+func TestBaseURL(t *testing.T) {
+	Convey("Base URL", t, func() {
+		So(Usher.Channel("cauthontv", nil).Scheme, ShouldEqual, "https")
+		So(API.URL("kraken/streams/cauthontv", nil).String(), ShouldEqual, "https://api.twitch.tv/kraken/streams/cauthontv.json")
+
+		twitch, err := NewTwitchAPI(&MockHTTPClient{}, "http://127.0.0.1:8080/proxy/")
+		So(err, ShouldBeNil)
+		So(twitch.URL("kraken/streams/cauthontv", nil).String(), ShouldEqual, "http://127.0.0.1:8080/proxy/kraken/streams/cauthontv.json")
+		So(twitch.Helix("client").URL("streams", nil).String(), ShouldEqual, "http://127.0.0.1:8080/proxy/helix/streams")
+
+		usher, err := NewUsherAPI("http://localhost:9000")
+		So(err, ShouldBeNil)
+		u := usher.Video("12345", nil)
+		So(u.Host, ShouldEqual, "localhost:9000")
+		So(u.Path, ShouldEqual, "vod/12345")
+
+		_, err = NewUsherAPI("usher.twitch.tv")
+		So(err, ShouldEqual, ErrBadBaseURL)
+	})
+}
+
+func TestErrors(t *testing.T) {
+	Convey("Errors", t, func() {
+		Convey("Not found", func() {
+			m := &MockHTTPClient{}
+			m.response = jsonResponse(`{"error":"Not Found","status":404,"message":"Channel 'foo' does not exist"}`, http.StatusNotFound)
+			client := TwitchAPI{httpClient: m}
+			_, err := client.Channel("foo")
+			So(errors.Is(err, ErrNotFound), ShouldBeTrue)
+			So(errors.Is(err, ErrServer), ShouldBeFalse)
+			var apiErr *Error
+			So(errors.As(err, &apiErr), ShouldBeTrue)
+			So(apiErr.StatusCode, ShouldEqual, http.StatusNotFound)
+			So(apiErr.Message, ShouldEqual, "Channel 'foo' does not exist")
+		})
+		Convey("Rate limited", func() {
+			m := &MockHTTPClient{}
+			m.response = jsonResponse(`{"error":"Too Many Requests"}`, http.StatusTooManyRequests)
+			m.response.Header = http.Header{}
+			m.response.Header.Set("Retry-After", "30")
+			client := TwitchAPI{httpClient: m}
+			_, err := client.Token(TokenLive, "test")
+			So(errors.Is(err, ErrRateLimited), ShouldBeTrue)
+			var apiErr *Error
+			So(errors.As(err, &apiErr), ShouldBeTrue)
+			So(apiErr.RetryAfter, ShouldEqual, 30*time.Second)
+			So(apiErr.Message, ShouldEqual, "Too Many Requests")
+		})
+		Convey("Server error", func() {
+			m := &MockHTTPClient{}
+			m.response = jsonResponse(`<html>Bad gateway</html>`, http.StatusBadGateway)
+			client := TwitchAPI{httpClient: m}
+			_, err := client.IsLive("test")
+			So(errors.Is(err, ErrServer), ShouldBeTrue)
+			So(err.Error(), ShouldEqual, "twitch: 502 Bad Gateway")
+		})
+		Convey("Unauthorized", func() {
+			m := &MockHTTPClient{}
+			m.response = jsonResponse(`{"message":"invalid client"}`, http.StatusUnauthorized)
+			client := TwitchAPI{httpClient: m}
+			_, err := client.Video("v123")
+			So(errors.Is(err, ErrUnauthorized), ShouldBeTrue)
+		})
+	})
+}
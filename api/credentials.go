@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTokenURL    = "https://id.twitch.tv/oauth2/token"
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+var ErrNoAccessToken = errors.New("No access token in response")
+
+type AppToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// Credentials obtains an app access token with the client credentials flow
+// and keeps it fresh. Use Client to wrap an HTTPClient with authentication.
+type Credentials struct {
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+	httpClient   HTTPClient
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	now     func() time.Time
+}
+
+func NewCredentials(client HTTPClient, clientID, clientSecret string) *Credentials {
+	return &Credentials{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     DefaultTokenURL,
+		httpClient:   client,
+		now:          time.Now,
+	}
+}
+
+func (c *Credentials) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+func (c *Credentials) fetch(ctx context.Context) (token AppToken, err error) {
+	tokenURL := c.TokenURL
+	if len(tokenURL) == 0 {
+		tokenURL = DefaultTokenURL
+	}
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := c.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer res.Body.Close()
+	if err := CheckResponse(res); err != nil {
+		return token, err
+	}
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&token); err != nil {
+		return token, err
+	}
+	if len(token.AccessToken) == 0 {
+		return token, ErrNoAccessToken
+	}
+	return token, nil
+}
+
+// Token returns the cached app access token, requesting a new one when
+// there is none or it expires within tokenRefreshMargin.
+func (c *Credentials) Token() (string, error) {
+	return c.TokenContext(context.Background())
+}
+
+func (c *Credentials) TokenContext(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock()
+	if len(c.token) > 0 && now.Add(tokenRefreshMargin).Before(c.expires) {
+		return c.token, nil
+	}
+	token, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token.AccessToken
+	c.expires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// Invalidate drops token if it is still the cached one, so the next call
+// to Token requests a new one.
+func (c *Credentials) Invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+		c.expires = time.Time{}
+	}
+}
+
+func (c *Credentials) Client(client HTTPClient) HTTPClient {
+	return authClient{credentials: c, client: client}
+}
+
+type authClient struct {
+	credentials *Credentials
+	client      HTTPClient
+}
+
+func (a authClient) authorize(req *http.Request, token string) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	r.Header.Set("Client-ID", a.credentials.ClientID)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r, nil
+}
+
+// Do sends req with the app access token. A 401 response invalidates the
+// token and the request is retried once with a new one.
+func (a authClient) Do(req *http.Request) (*http.Response, error) {
+	token, err := a.credentials.TokenContext(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	r, err := a.authorize(req, token)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.client.Do(r)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	res.Body.Close()
+	a.credentials.Invalidate(token)
+	if token, err = a.credentials.TokenContext(req.Context()); err != nil {
+		return nil, err
+	}
+	if r, err = a.authorize(req, token); err != nil {
+		return nil, err
+	}
+	return a.client.Do(r)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCredentials(t *testing.T) {
+	Convey("Credentials", t, func() {
+		var (
+			issued   int
+			rejected = map[string]bool{}
+			auth     []string
+			now      = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		)
+		m := &MockHTTPClient{}
+		m.callback = func(req *http.Request) (*http.Response, error) {
+			if req.URL.String() == DefaultTokenURL {
+				So(req.Method, ShouldEqual, "POST")
+				So(req.ParseForm(), ShouldBeNil)
+				So(req.PostForm.Get("grant_type"), ShouldEqual, "client_credentials")
+				So(req.PostForm.Get("client_secret"), ShouldEqual, "secret")
+				issued++
+				return jsonResponse(fmt.Sprintf(`{"access_token": "token%d", "expires_in": 3600, "token_type": "bearer"}`, issued), http.StatusOK), nil
+			}
+			header := req.Header.Get("Authorization")
+			auth = append(auth, header)
+			So(req.Header.Get("Client-ID"), ShouldEqual, "client")
+			if rejected[header] {
+				return jsonResponse(`{"error": "Unauthorized", "status": 401, "message": "Invalid OAuth token"}`, http.StatusUnauthorized), nil
+			}
+			return jsonResponse(`{"token": "{}", "sig": "abc"}`, http.StatusOK), nil
+		}
+		c := NewCredentials(m, "client", "secret")
+		c.now = func() time.Time { return now }
+		client := TwitchAPI{httpClient: c.Client(m)}
+
+		Convey("Cached", func() {
+			_, err := client.Token(TokenLive, "test")
+			So(err, ShouldBeNil)
+			_, err = client.Token(TokenLive, "test")
+			So(err, ShouldBeNil)
+			So(issued, ShouldEqual, 1)
+			So(auth, ShouldResemble, []string{"Bearer token1", "Bearer token1"})
+		})
+		Convey("Literal", func() {
+			c := &Credentials{ClientID: "client", ClientSecret: "secret", httpClient: m}
+			token, err := c.Token()
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "token1")
+		})
+		Convey("Refresh before expiry", func() {
+			_, err := c.Token()
+			So(err, ShouldBeNil)
+			now = now.Add(time.Hour - time.Minute)
+			token, err := c.Token()
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "token2")
+		})
+		Convey("Retry after 401", func() {
+			rejected["Bearer token1"] = true
+			tok, err := client.Token(TokenLive, "test")
+			So(err, ShouldBeNil)
+			So(tok.Sig, ShouldEqual, "abc")
+			So(issued, ShouldEqual, 2)
+			So(auth, ShouldResemble, []string{"Bearer token1", "Bearer token2"})
+		})
+		Convey("Only once", func() {
+			rejected["Bearer token1"] = true
+			rejected["Bearer token2"] = true
+			_, err := client.Token(TokenLive, "test")
+			So(errors.Is(err, ErrUnauthorized), ShouldBeTrue)
+			So(len(auth), ShouldEqual, 2)
+		})
+	})
+}
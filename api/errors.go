@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxErrorBody = 64 << 10
+
+var (
+	ErrNotFound     = errors.New("Not found")
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrRateLimited  = errors.New("Rate limited")
+	ErrServer       = errors.New("Server error")
+)
+
+// Error is returned for every non-2xx response of the API. It matches
+// ErrNotFound, ErrUnauthorized, ErrRateLimited or ErrServer with errors.Is.
+type Error struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if len(e.Message) == 0 {
+		return fmt.Sprintf("twitch: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("twitch: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if v := header.Get("Retry-After"); len(v) > 0 {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil && t.After(now) {
+			return t.Sub(now)
+		}
+	}
+	if v := header.Get("Ratelimit-Reset"); len(v) > 0 {
+		if reset, err := strconv.ParseInt(v, 10, 64); err == nil {
+			if t := time.Unix(reset, 0); t.After(now) {
+				return t.Sub(now)
+			}
+		}
+	}
+	return 0
+}
+
+// CheckResponse returns an *Error for non-2xx responses, reading the
+// message from the Twitch error body when there is one.
+func CheckResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	e := &Error{StatusCode: res.StatusCode}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		e.RetryAfter = retryAfter(res.Header, time.Now())
+	}
+	if res.Body == nil {
+		return e
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	if err != nil {
+		return e
+	}
+	var payload struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		e.Message = payload.Message
+		if len(e.Message) == 0 {
+			e.Message = payload.Error
+		}
+	}
+	return e
+}
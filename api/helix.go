@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	helixPath     = "helix"
+	HelixPageSize = 100
+	MaxLogins     = 100
+)
+
+var ErrTooManyLogins = errors.New("Too many logins for one request")
+
+// ChannelAPI is implemented by both the kraken TwitchAPI and Helix.
+type ChannelAPI interface {
+	Channel(name string) (Channel, error)
+	ChannelContext(ctx context.Context, name string) (Channel, error)
+	IsLive(name string) (bool, error)
+	IsLiveContext(ctx context.Context, name string) (bool, error)
+}
+
+type Helix struct {
+	httpClient HTTPClient
+	ClientID   string
+	base       *url.URL
+}
+
+type Pagination struct {
+	Cursor string `json:"cursor"`
+}
+
+type HelixStream struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	UserLogin    string    `json:"user_login"`
+	UserName     string    `json:"user_name"`
+	GameID       string    `json:"game_id"`
+	GameName     string    `json:"game_name"`
+	Type         string    `json:"type"`
+	Title        string    `json:"title"`
+	ViewerCount  int       `json:"viewer_count"`
+	StartedAt    time.Time `json:"started_at"`
+	Language     string    `json:"language"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+}
+
+type HelixUser struct {
+	ID              string    `json:"id"`
+	Login           string    `json:"login"`
+	DisplayName     string    `json:"display_name"`
+	Type            string    `json:"type"`
+	BroadcasterType string    `json:"broadcaster_type"`
+	Description     string    `json:"description"`
+	ProfileImageURL string    `json:"profile_image_url"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type HelixChannel struct {
+	BroadcasterID       string `json:"broadcaster_id"`
+	BroadcasterLogin    string `json:"broadcaster_login"`
+	BroadcasterName     string `json:"broadcaster_name"`
+	BroadcasterLanguage string `json:"broadcaster_language"`
+	GameID              string `json:"game_id"`
+	GameName            string `json:"game_name"`
+	Title               string `json:"title"`
+	Delay               int    `json:"delay"`
+}
+
+type HelixVideo struct {
+	ID           string    `json:"id"`
+	StreamID     string    `json:"stream_id"`
+	UserID       string    `json:"user_id"`
+	UserLogin    string    `json:"user_login"`
+	UserName     string    `json:"user_name"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	CreatedAt    time.Time `json:"created_at"`
+	PublishedAt  time.Time `json:"published_at"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	Viewable     string    `json:"viewable"`
+	ViewCount    int       `json:"view_count"`
+	Language     string    `json:"language"`
+	Type         string    `json:"type"`
+	Duration     string    `json:"duration"`
+}
+
+type HelixGame struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	BoxArtURL string `json:"box_art_url"`
+}
+
+func NewHelix(client HTTPClient, clientID string) Helix {
+	return Helix{httpClient: client, ClientID: clientID}
+}
+
+func (h Helix) URL(endpoint string, params url.Values) (u *url.URL) {
+	u = resolve(h.base, DefaultAPIURL, path.Join("/", helixPath, endpoint))
+	values := u.Query()
+	for k, v := range params {
+		values[k] = v
+	}
+	u.RawQuery = values.Encode()
+	return u
+}
+
+func (h Helix) get(endpoint string, params url.Values, data interface{}) (cursor string, err error) {
+	return h.getContext(context.Background(), endpoint, params, data)
+}
+
+func (h Helix) getContext(ctx context.Context, endpoint string, params url.Values, data interface{}) (cursor string, err error) {
+	req := mustGet(h.URL(endpoint, params)).WithContext(ctx)
+	if len(h.ClientID) > 0 {
+		req.Header.Set("Client-ID", h.ClientID)
+	}
+	res, err := Limiter.do(ctx, h.httpClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := CheckResponse(res); err != nil {
+		return "", err
+	}
+	payload := struct {
+		Data       interface{} `json:"data"`
+		Pagination Pagination  `json:"pagination"`
+	}{Data: data}
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		return "", err
+	}
+	return payload.Pagination.Cursor, nil
+}
+
+func withCursor(params url.Values, after string) url.Values {
+	values := url.Values{}
+	for k, v := range params {
+		values[k] = v
+	}
+	if len(after) > 0 {
+		values.Set("after", after)
+	}
+	return values
+}
+
+// EachPage calls page with an empty cursor and then with every cursor it
+// returns, until the last page is reached.
+func EachPage(page func(after string) (cursor string, err error)) error {
+	var after string
+	for {
+		cursor, err := page(after)
+		if err != nil {
+			return err
+		}
+		if len(cursor) == 0 || cursor == after {
+			return nil
+		}
+		after = cursor
+	}
+}
+
+// Streams returns live streams filtered by user_login, user_id, game_id or
+// language params and the cursor of the next page.
+func (h Helix) Streams(params url.Values, after string) (streams []HelixStream, cursor string, err error) {
+	return h.StreamsContext(context.Background(), params, after)
+}
+
+func (h Helix) StreamsContext(ctx context.Context, params url.Values, after string) (streams []HelixStream, cursor string, err error) {
+	cursor, err = h.getContext(ctx, "streams", withCursor(params, after), &streams)
+	return streams, cursor, err
+}
+
+func (h Helix) Users(params url.Values) (users []HelixUser, err error) {
+	_, err = h.get("users", params, &users)
+	return users, err
+}
+
+func (h Helix) Channels(params url.Values) (channels []HelixChannel, err error) {
+	_, err = h.get("channels", params, &channels)
+	return channels, err
+}
+
+func (h Helix) Videos(params url.Values, after string) (videos []HelixVideo, cursor string, err error) {
+	cursor, err = h.get("videos", withCursor(params, after), &videos)
+	return videos, cursor, err
+}
+
+func (h Helix) Games(params url.Values) (games []HelixGame, err error) {
+	_, err = h.get("games", params, &games)
+	return games, err
+}
+
+func (s HelixStream) Stream() *Stream {
+	stream := &Stream{Game: s.GameName, Viewers: s.ViewerCount, CreatedAt: s.StartedAt}
+	stream.ID, _ = strconv.ParseInt(s.ID, 10, 64)
+	stream.Data.Name = s.UserName
+	stream.Data.Status = s.Title
+	return stream
+}
+
+func (s HelixStream) live() bool {
+	return s.Type == "live" || len(s.Type) == 0
+}
+
+// LiveStreams checks up to MaxLogins channels in one request and returns
+// the streams of those that are live, keyed by lowercase login.
+func (h Helix) LiveStreams(logins []string) (map[string]HelixStream, error) {
+	return h.LiveStreamsContext(context.Background(), logins)
+}
+
+func (h Helix) LiveStreamsContext(ctx context.Context, logins []string) (map[string]HelixStream, error) {
+	if len(logins) > MaxLogins {
+		return nil, ErrTooManyLogins
+	}
+	live := make(map[string]HelixStream)
+	if len(logins) == 0 {
+		return live, nil
+	}
+	params := url.Values{"first": {strconv.Itoa(MaxLogins)}}
+	for _, login := range logins {
+		params.Add("user_login", strings.ToLower(login))
+	}
+	streams, _, err := h.StreamsContext(ctx, params, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		if s.live() {
+			live[strings.ToLower(s.UserLogin)] = s
+		}
+	}
+	return live, nil
+}
+
+func (h Helix) Channel(name string) (channel Channel, err error) {
+	return h.ChannelContext(context.Background(), name)
+}
+
+func (h Helix) ChannelContext(ctx context.Context, name string) (channel Channel, err error) {
+	var streams []HelixStream
+	_, err = h.getContext(ctx, "streams", url.Values{"user_login": {name}}, &streams)
+	if err != nil {
+		return channel, err
+	}
+	for _, s := range streams {
+		if s.live() {
+			channel.Stream = s.Stream()
+			break
+		}
+	}
+	return channel, nil
+}
+
+func (h Helix) IsLive(name string) (live bool, err error) {
+	return h.IsLiveContext(context.Background(), name)
+}
+
+func (h Helix) IsLiveContext(ctx context.Context, name string) (live bool, err error) {
+	c, err := h.ChannelContext(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return c.Stream != nil, nil
+}
+
+var (
+	_ ChannelAPI = TwitchAPI{}
+	_ ChannelAPI = Helix{}
+)
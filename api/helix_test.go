@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const helixStreams = `{
+  "data": [{
+    "id": "40952121085",
+    "user_id": "101051819",
+    "user_login": "cauthontv",
+    "user_name": "CauthonTV",
+    "game_id": "29595",
+    "game_name": "Dota 2",
+    "type": "live",
+    "title": "ranked",
+    "viewer_count": 1234,
+    "started_at": "2021-03-10T15:04:21Z",
+    "language": "ru"
+  }],
+  "pagination": {"cursor": "eyJiIjp7IkN1cnNvciI6"}
+}`
+
+func TestHelix(t *testing.T) {
+	Convey("Helix", t, func() {
+		var requests []*http.Request
+		m := &MockHTTPClient{}
+		m.callback = func(req *http.Request) (*http.Response, error) {
+			requests = append(requests, req)
+			if req.URL.Query().Get("user_login") == "offline" {
+				return jsonResponse(`{"data": [], "pagination": {}}`, http.StatusOK), nil
+			}
+			return jsonResponse(helixStreams, http.StatusOK), nil
+		}
+		h := NewHelix(m, "client")
+
+		Convey("URL", func() {
+			u := h.URL("streams", url.Values{"user_login": {"a", "b"}})
+			So(u.String(), ShouldEqual, "https://api.twitch.tv/helix/streams?user_login=a&user_login=b")
+		})
+		Convey("Streams", func() {
+			streams, cursor, err := h.Streams(url.Values{"user_login": {"cauthontv"}}, "")
+			So(err, ShouldBeNil)
+			So(cursor, ShouldEqual, "eyJiIjp7IkN1cnNvciI6")
+			So(len(streams), ShouldEqual, 1)
+			So(streams[0].ViewerCount, ShouldEqual, 1234)
+			So(streams[0].StartedAt.Year(), ShouldEqual, 2021)
+			So(requests[0].Header.Get("Client-ID"), ShouldEqual, "client")
+		})
+		Convey("Channel", func() {
+			c, err := h.Channel("cauthontv")
+			So(err, ShouldBeNil)
+			So(c.Stream, ShouldNotBeNil)
+			So(c.Stream.ID, ShouldEqual, 40952121085)
+			So(c.Stream.Game, ShouldEqual, "Dota 2")
+			So(c.Stream.Data.Name, ShouldEqual, "CauthonTV")
+			So(c.Stream.Data.Status, ShouldEqual, "ranked")
+			live, err := h.IsLive("offline")
+			So(err, ShouldBeNil)
+			So(live, ShouldBeFalse)
+		})
+		Convey("LiveStreams", func() {
+			live, err := h.LiveStreams([]string{"CauthonTV", "other"})
+			So(err, ShouldBeNil)
+			So(len(requests), ShouldEqual, 1)
+			So(requests[0].URL.Query()["user_login"], ShouldResemble, []string{"cauthontv", "other"})
+			So(live, ShouldContainKey, "cauthontv")
+			So(live["cauthontv"].ViewerCount, ShouldEqual, 1234)
+			So(live, ShouldNotContainKey, "other")
+			_, err = h.LiveStreams(make([]string, MaxLogins+1))
+			So(err, ShouldEqual, ErrTooManyLogins)
+		})
+		Convey("Pagination", func() {
+			var cursors []string
+			err := EachPage(func(after string) (string, error) {
+				cursors = append(cursors, after)
+				if len(cursors) == 3 {
+					return "", nil
+				}
+				return fmt.Sprint("page", len(cursors)), nil
+			})
+			So(err, ShouldBeNil)
+			So(cursors, ShouldResemble, []string{"", "page1", "page2"})
+
+			_, _, err = h.Videos(url.Values{"user_id": {"101051819"}}, "page1")
+			So(err, ShouldBeNil)
+			So(requests[0].URL.Query().Get("after"), ShouldEqual, "page1")
+		})
+	})
+}
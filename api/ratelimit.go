@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimit  = 800
+	defaultRatePeriod = time.Minute
+)
+
+// Limiter throttles every TwitchAPI and Helix request made by the process.
+var Limiter = NewRateLimiter(defaultRateLimit, defaultRatePeriod)
+
+// RateLimiter is a token bucket that is refilled at a constant rate and
+// corrected by the Ratelimit-Remaining and Ratelimit-Reset response headers.
+type RateLimiter struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+	reset    time.Time
+	blocked  bool
+	now      func() time.Time
+	sleep    func(context.Context, time.Duration) error
+}
+
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{
+		capacity: float64(limit),
+		rate:     float64(limit) / period.Seconds(),
+		tokens:   float64(limit),
+		now:      time.Now,
+		sleep:    sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.blocked && !now.Before(l.reset) {
+		l.blocked = false
+		l.tokens = l.capacity
+	}
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.capacity {
+			l.tokens = l.capacity
+		}
+	}
+	l.last = now
+}
+
+// reserve takes a token or returns how long to wait for one.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.refill(now)
+	if l.blocked {
+		return l.reset.Sub(now)
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Wait blocks until a request is allowed.
+func (l *RateLimiter) Wait() {
+	l.WaitContext(context.Background())
+}
+
+// WaitContext blocks until a request is allowed or ctx is done.
+func (l *RateLimiter) WaitContext(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wait := l.reserve()
+		if wait <= 0 {
+			return nil
+		}
+		if err := l.sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// Update adjusts the bucket to the budget reported by the server.
+func (l *RateLimiter) Update(h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.now())
+	if float64(remaining) < l.tokens {
+		l.tokens = float64(remaining)
+	}
+	if remaining > 0 {
+		return
+	}
+	reset, err := strconv.ParseInt(h.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.reset = time.Unix(reset, 0)
+	l.blocked = l.now().Before(l.reset)
+}
+
+// Remaining returns the number of requests that can be made right now
+// without waiting.
+func (l *RateLimiter) Remaining() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.now())
+	if l.blocked {
+		return 0
+	}
+	return int(l.tokens)
+}
+
+func (l *RateLimiter) do(ctx context.Context, client HTTPClient, req *http.Request) (*http.Response, error) {
+	if err := l.WaitContext(ctx); err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	l.Update(res.Header)
+	return res, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimiter(t *testing.T) {
+	Convey("RateLimiter", t, func() {
+		now := time.Unix(1500000000, 0)
+		var slept []time.Duration
+		l := NewRateLimiter(2, time.Second)
+		l.now = func() time.Time { return now }
+		l.sleep = func(ctx context.Context, d time.Duration) error {
+			slept = append(slept, d)
+			now = now.Add(d)
+			return ctx.Err()
+		}
+
+		Convey("Bucket", func() {
+			l.Wait()
+			l.Wait()
+			So(slept, ShouldBeEmpty)
+			So(l.Remaining(), ShouldEqual, 0)
+			l.Wait()
+			So(slept, ShouldResemble, []time.Duration{500 * time.Millisecond})
+			now = now.Add(time.Hour)
+			So(l.Remaining(), ShouldEqual, 2)
+		})
+		Convey("Headers", func() {
+			h := http.Header{}
+			h.Set("Ratelimit-Remaining", "1")
+			l.Update(h)
+			So(l.Remaining(), ShouldEqual, 1)
+
+			h.Set("Ratelimit-Remaining", "0")
+			h.Set("Ratelimit-Reset", "1500000010")
+			l.Update(h)
+			So(l.Remaining(), ShouldEqual, 0)
+			l.Wait()
+			So(slept, ShouldResemble, []time.Duration{10 * time.Second})
+			So(l.Remaining(), ShouldEqual, 1)
+		})
+		Convey("Cancel", func() {
+			l.Wait()
+			l.Wait()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(l.WaitContext(ctx), ShouldEqual, context.Canceled)
+		})
+		Convey("Shared", func() {
+			m := &MockHTTPClient{}
+			m.callback = func(req *http.Request) (*http.Response, error) {
+				res := jsonResponse(`{"data": [], "pagination": {}}`, http.StatusOK)
+				res.Header = http.Header{}
+				res.Header.Set("Ratelimit-Remaining", "0")
+				res.Header.Set("Ratelimit-Reset", "1500000005")
+				return res, nil
+			}
+			defer func(old *RateLimiter) { Limiter = old }(Limiter)
+			Limiter = l
+			_, err := NewHelix(m, "client").Users(nil)
+			So(err, ShouldBeNil)
+			_, err = NewHelix(m, "other").Users(nil)
+			So(err, ShouldBeNil)
+			So(slept, ShouldResemble, []time.Duration{5 * time.Second})
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitRetries is how many times a chat message is resent after
+	// the service answers 429 Too Many Requests.
+	maxRateLimitRetries = 3
+	chatQueueSize       = 32
+)
+
+var (
+	ErrChatQueueFull = errors.New("Chat queue full, message dropped")
+	ErrChatClosed    = errors.New("Chat webhook closed")
+	ErrBadChatURL    = errors.New("Chat webhook URL must be absolute http(s)")
+)
+
+// chatWebhook posts JSON to a chat service incoming webhook from a
+// background goroutine that waits out its rate limits, so a slow or
+// limited service never blocks the caller.
+type chatWebhook struct {
+	url     string
+	client  HTTPClient
+	after   func(time.Duration) <-chan time.Time
+	now     func() time.Time
+	queue   chan []byte
+	pending sync.WaitGroup
+	done    chan struct{}
+	stopped sync.Once
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+func newChatWebhook(client HTTPClient, raw string) (*chatWebhook, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, ErrBadChatURL
+	}
+	c := &chatWebhook{
+		url:    raw,
+		client: client,
+		after:  time.After,
+		now:    time.Now,
+		queue:  make(chan []byte, chatQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// rateLimitDelay reads the delay requested by a 429 response from the
+// Retry-After header or the retry_after field of the body, both in seconds.
+func rateLimitDelay(res *http.Response, body []byte) time.Duration {
+	seconds, err := strconv.ParseFloat(res.Header.Get("Retry-After"), 64)
+	if err != nil {
+		var payload struct {
+			RetryAfter float64 `json:"retry_after"`
+		}
+		json.Unmarshal(body, &payload)
+		seconds = payload.RetryAfter
+	}
+	if seconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// update remembers when an exhausted rate limit bucket resets.
+func (c *chatWebhook) update(header http.Header) {
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	seconds, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+	c.until = c.now().Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// post queues the payload for delivery, dropping it when the queue is full.
+func (c *chatWebhook) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.done:
+		return ErrChatClosed
+	default:
+	}
+	c.pending.Add(1)
+	select {
+	case c.queue <- body:
+		return nil
+	default:
+		c.pending.Done()
+		return ErrChatQueueFull
+	}
+}
+
+func (c *chatWebhook) run() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case body := <-c.queue:
+			if err := c.send(body); err != nil {
+				log.Println("chat message failed:", err)
+			}
+			c.pending.Done()
+		}
+	}
+}
+
+// stop abandons the queued messages and any rate limit wait in progress.
+func (c *chatWebhook) stop() {
+	c.stopped.Do(func() { close(c.done) })
+}
+
+// flush waits for the queue to drain.
+func (c *chatWebhook) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *chatWebhook) send(body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if wait := c.until.Sub(c.now()); wait > 0 {
+			select {
+			case <-c.done:
+				return ErrChatClosed
+			case <-c.after(wait):
+			}
+		}
+		req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.update(res.Header)
+		switch {
+		case res.StatusCode == http.StatusTooManyRequests && attempt < maxRateLimitRetries:
+			c.until = c.now().Add(rateLimitDelay(res, data))
+		case res.StatusCode < 200 || res.StatusCode >= 300:
+			return StatusError{URL: c.url, StatusCode: res.StatusCode}
+		default:
+			return nil
+		}
+	}
+}
+
+// headline is the text shown above the event details.
+func headline(event Event) string {
+	if len(event.Message) > 0 {
+		return event.Message
+	}
+	return DefaultMessages.Event(event)
+}
+
+type chatField struct {
+	Name, Value string
+}
+
+// chatFields lists the recording details worth showing for the event.
+func chatFields(event Event) (fields []chatField) {
+	add := func(name, value string) {
+		if len(value) > 0 {
+			fields = append(fields, chatField{name, value})
+		}
+	}
+	m := DefaultMessages
+	data := m.Data(event)
+	add(m.Text(MessageChannel, data), data.Channel)
+	add(m.Text(MessageTitle, data), data.Title)
+	add(m.Text(MessageGame, data), data.Game)
+	if event.Duration > 0 {
+		add(m.Text(MessageDuration, data), data.Duration.String())
+	}
+	if event.Size > 0 {
+		add(m.Text(MessageSize, data), data.Size.String())
+	}
+	return fields
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func channelURL(channel string) string {
+	return "https://www.twitch.tv/" + channel
+}
@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// chatReceiver answers the first limited requests with 429.
+type chatReceiver struct {
+	mu      sync.Mutex
+	limited int
+	header  http.Header
+	body    string
+	bodies  [][]byte
+}
+
+func (r *chatReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limited > 0 {
+		r.limited--
+		for k, v := range r.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(r.body))
+		return
+	}
+	r.bodies = append(r.bodies, body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestChat(t *testing.T) {
+	Convey("Chat webhooks", t, func() {
+		receiver := &chatReceiver{}
+		srv := httptest.NewServer(receiver)
+		defer srv.Close()
+		var slept []time.Duration
+		after := func(d time.Duration) <-chan time.Time {
+			slept = append(slept, d)
+			return time.After(0)
+		}
+		now := time.Unix(0, 0)
+		clock := func() time.Time { return now }
+
+		event := Event{
+			Type:     EventFinished,
+			Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Channel:  "streamer",
+			File:     "streamer.ts",
+			Duration: 90 * time.Minute,
+			Size:     3 << 29,
+			Metadata: &Metadata{Title: "a <b> & c", Game: "game"},
+			Message:  "Запись для канала streamer завершена",
+		}
+
+		Convey("Discord", func() {
+			d, err := NewDiscord(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			d.hook.after, d.hook.now = after, clock
+			receiver.limited = 1
+			receiver.body = `{"message": "You are being rate limited.", "retry_after": 0.5, "global": false}`
+			So(d.NotifyEvent(event), ShouldBeNil)
+			So(d.Flush(context.Background()), ShouldBeNil)
+			So(slept, ShouldResemble, []time.Duration{500 * time.Millisecond})
+
+			var msg discordMessage
+			So(json.Unmarshal(receiver.bodies[0], &msg), ShouldBeNil)
+			So(len(msg.Embeds), ShouldEqual, 1)
+			embed := msg.Embeds[0]
+			So(embed.Title, ShouldEqual, event.Message)
+			So(embed.URL, ShouldEqual, "https://www.twitch.tv/streamer")
+			So(embed.Timestamp, ShouldEqual, "2020-01-02T03:04:05Z")
+			So(embed.Fields, ShouldResemble, []discordField{
+				{"Канал", "streamer", true},
+				{"Название", "a <b> & c", true},
+				{"Игра", "game", true},
+				{"Продолжительность", "1 ч 30 мин", true},
+				{"Размер", "1.5 GiB", true},
+			})
+
+			So(d.Notify("hello"), ShouldBeNil)
+			So(d.Flush(context.Background()), ShouldBeNil)
+			So(json.Unmarshal(receiver.bodies[1], &msg), ShouldBeNil)
+			So(msg.Content, ShouldEqual, "hello")
+		})
+		Convey("Discord bucket", func() {
+			d, err := NewDiscord(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			d.hook.after, d.hook.now = after, clock
+			d.hook.update(http.Header{
+				"X-Ratelimit-Remaining":   {"0"},
+				"X-Ratelimit-Reset-After": {"2"},
+			})
+			So(d.Notify("hello"), ShouldBeNil)
+			So(d.Flush(context.Background()), ShouldBeNil)
+			So(slept, ShouldResemble, []time.Duration{2 * time.Second})
+		})
+		Convey("Slack", func() {
+			s, err := NewSlack(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			s.hook.after, s.hook.now = after, clock
+			receiver.limited = 1
+			receiver.header = http.Header{"Retry-After": {"3"}}
+			So(s.NotifyEvent(event), ShouldBeNil)
+			So(s.Flush(context.Background()), ShouldBeNil)
+			So(slept, ShouldResemble, []time.Duration{3 * time.Second})
+
+			var msg slackMessage
+			So(json.Unmarshal(receiver.bodies[0], &msg), ShouldBeNil)
+			So(msg.Text, ShouldEqual, event.Message)
+			So(len(msg.Blocks), ShouldEqual, 2)
+			So(msg.Blocks[0].Text.Text, ShouldContainSubstring, "<https://www.twitch.tv/streamer|")
+			So(msg.Blocks[1].Fields[1].Text, ShouldEqual, "*Название*\na &lt;b&gt; &amp; c")
+		})
+		Convey("Give up", func() {
+			s, err := NewSlack(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			s.hook.after, s.hook.now = after, clock
+			receiver.limited = maxRateLimitRetries + 1
+			So(s.hook.send([]byte("{}")), ShouldResemble, StatusError{URL: srv.URL, StatusCode: http.StatusTooManyRequests})
+			So(len(slept), ShouldEqual, maxRateLimitRetries)
+			So(receiver.bodies, ShouldBeEmpty)
+		})
+		Convey("Rate limit does not block callers", func() {
+			d, err := NewDiscord(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			waiting := make(chan struct{})
+			release := make(chan struct{})
+			var once sync.Once
+			d.hook.after = func(time.Duration) <-chan time.Time {
+				once.Do(func() {
+					close(waiting)
+					<-release
+				})
+				return time.After(0)
+			}
+			d.hook.now = clock
+			d.hook.until = now.Add(time.Minute)
+			So(d.Notify("first"), ShouldBeNil)
+			<-waiting
+			for i := 0; i < chatQueueSize; i++ {
+				So(d.Notify("queued"), ShouldBeNil)
+			}
+			So(d.Notify("dropped"), ShouldEqual, ErrChatQueueFull)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			So(d.Flush(ctx), ShouldEqual, context.DeadlineExceeded)
+			close(release)
+			So(d.Flush(context.Background()), ShouldBeNil)
+			So(len(receiver.bodies), ShouldEqual, chatQueueSize+1)
+		})
+		Convey("Close stops a rate limit wait", func() {
+			d, err := NewDiscord(srv.Client(), srv.URL)
+			So(err, ShouldBeNil)
+			d.hook.until = time.Now().Add(time.Hour)
+			So(d.Notify("hello"), ShouldBeNil)
+			So(d.Close(), ShouldBeNil)
+			So(d.hook.send([]byte("{}")), ShouldEqual, ErrChatClosed)
+			So(d.Notify("late"), ShouldEqual, ErrChatClosed)
+			So(receiver.bodies, ShouldBeEmpty)
+		})
+		Convey("Bad URL", func() {
+			for _, raw := range []string{"", "discord.com/api/webhooks/1", "ftp://example.com", "http://%zz"} {
+				_, err := NewDiscord(srv.Client(), raw)
+				So(err, ShouldNotBeNil)
+				_, err = NewSlack(srv.Client(), raw)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
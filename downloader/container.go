@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"errors"
+	"io"
+
+	"github.com/cydev/twitch/mp4"
+)
+
+const (
+	FormatTS  = "ts"
+	FormatMP4 = "mp4"
+)
+
+var ErrBadFormat = errors.New("Bad format")
+
+// muxer writes downloaded MPEG-TS segments into the recording container.
+type muxer interface {
+	WriteSegment(segment []byte) (written int64, err error)
+	Position() (dts, decodeTime uint64)
+}
+
+type tsMuxer struct {
+	w io.Writer
+}
+
+func (m tsMuxer) WriteSegment(segment []byte) (int64, error) {
+	n, err := m.w.Write(segment)
+	return int64(n), err
+}
+
+func (m tsMuxer) Position() (uint64, uint64) {
+	return 0, 0
+}
+
+type mp4Muxer struct {
+	w *mp4.FragmentWriter
+}
+
+func (m mp4Muxer) WriteSegment(segment []byte) (int64, error) {
+	tracks, err := mp4.ReadTS(segment)
+	if err != nil {
+		return 0, err
+	}
+	return m.w.WriteFragment(tracks)
+}
+
+func (m mp4Muxer) Position() (uint64, uint64) {
+	return m.w.Last()
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case FormatTS, FormatMP4:
+		return nil
+	}
+	return ErrBadFormat
+}
+
+// newMuxer returns the muxer for the recording in f. A fragmented MP4 with
+// segments in the ledger is continued with the tracks of its init segment.
+func newMuxer(format string, f io.ReadWriter, ledger *Ledger) (muxer, error) {
+	switch format {
+	case FormatTS:
+		return tsMuxer{f}, nil
+	case FormatMP4:
+		fw := mp4.NewFragmentWriter(f)
+		if last, ok := ledger.Last(); ok {
+			tracks, err := mp4.InitTracks(f)
+			if err != nil {
+				return nil, err
+			}
+			fw.Resume(uint32(ledger.Len()), last.DTS, last.Time, tracks)
+		}
+		return mp4Muxer{fw}, nil
+	}
+	return nil, ErrBadFormat
+}
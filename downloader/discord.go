@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"context"
+	"time"
+)
+
+var discordColors = map[EventType]int{
+	EventOnline:   0x9146ff,
+	EventStarted:  0x2ecc71,
+	EventProgress: 0x3498db,
+	EventFinished: 0x95a5a6,
+	EventError:    0xe74c3c,
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title     string         `json:"title"`
+	URL       string         `json:"url,omitempty"`
+	Color     int            `json:"color,omitempty"`
+	Timestamp string         `json:"timestamp,omitempty"`
+	Fields    []discordField `json:"fields,omitempty"`
+}
+
+type discordMessage struct {
+	Content string         `json:"content,omitempty"`
+	Embeds  []discordEmbed `json:"embeds,omitempty"`
+}
+
+// Discord posts events as embeds to a Discord incoming webhook.
+type Discord struct {
+	hook *chatWebhook
+}
+
+func NewDiscord(client HTTPClient, url string) (*Discord, error) {
+	hook, err := newChatWebhook(client, url)
+	if err != nil {
+		return nil, err
+	}
+	return &Discord{hook: hook}, nil
+}
+
+// Flush waits until the queued messages are delivered or ctx is done.
+func (d *Discord) Flush(ctx context.Context) error {
+	return d.hook.flush(ctx)
+}
+
+// Close drops the messages still queued.
+func (d *Discord) Close() error {
+	d.hook.stop()
+	return nil
+}
+
+func (d *Discord) Notify(message string) error {
+	return d.hook.post(discordMessage{Content: message})
+}
+
+func (d *Discord) NotifyEvent(event Event) error {
+	if event.Type == EventMessage {
+		return d.Notify(event.Message)
+	}
+	embed := discordEmbed{
+		Title: headline(event),
+		URL:   channelURL(event.Channel),
+		Color: discordColors[event.Type],
+	}
+	if !event.Time.IsZero() {
+		embed.Timestamp = event.Time.UTC().Format(time.RFC3339)
+	}
+	for _, f := range chatFields(event) {
+		embed.Fields = append(embed.Fields, discordField{Name: f.Name, Value: f.Value, Inline: true})
+	}
+	return d.hook.post(discordMessage{Embeds: []discordEmbed{embed}})
+}
@@ -1,11 +1,13 @@
 package downloader
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -13,16 +15,15 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cydev/twitch/api"
-	"github.com/cydev/twitch/telegram"
-	"github.com/golang/groupcache/lru"
+	"github.com/cydev/twitch/mp4"
 	"github.com/grafov/m3u8"
 )
 
 const (
-	targetVideo          = "chunked"
 	checkInterval        = time.Second * 8
 	downloadInterval     = time.Second * 8
 	notificationInterval = time.Hour
@@ -35,15 +36,32 @@ const (
 var (
 	ErrStreamOffline       = errors.New("Stream offline")
 	ErrTargetVideoNotFound = errors.New("Target not found")
+	ErrLedger              = errors.New("Ledger write failed")
 	workdir                string
-	chatRoom               int
-	telegramToken          string
+	concurrency            int
+	quality                string
+	fileNamePattern        string
+	format                 string
+	workers                int
+	maxBuffered            int64
+	clientID               string
+	clientSecret           string
+	apiURL                 string
+	usherURL               string
 )
 
 func init() {
 	flag.StringVar(&workdir, "dir", "", "Working directory")
-	flag.IntVar(&chatRoom, "chat", 1863832, "Telegram chat id")
-	flag.StringVar(&telegramToken, "telegram-token", "", "Token for telegram bot")
+	flag.StringVar(&quality, "quality", "source,best", "Comma separated list of preferred qualities, e.g. source,720p60,best:1080p,audio_only")
+	flag.StringVar(&fileNamePattern, "filename", defaultFileNamePattern, "Recording file name pattern, supports {channel}, {id}, {title}, {game} and {start}")
+	flag.StringVar(&format, "format", FormatTS, "Recording container: ts or mp4 (fragmented)")
+	flag.IntVar(&workers, "workers", 4, "Concurrent segment downloads per channel")
+	flag.Int64Var(&maxBuffered, "max-buffer", 64<<20, "Maximum bytes of segments buffered ahead of the writer")
+	flag.StringVar(&clientID, "client-id", "", "Twitch application client ID, enables the Helix API")
+	flag.StringVar(&clientSecret, "client-secret", "", "Twitch application client secret for app access tokens")
+	flag.StringVar(&apiURL, "api-url", api.DefaultAPIURL, "Twitch API base URL")
+	flag.StringVar(&usherURL, "usher-url", api.DefaultUsherURL, "Usher base URL")
+	flag.IntVar(&concurrency, "concurrency", 8, "Maximum concurrent HTTP requests for all channels")
 }
 
 type HTTPClient interface {
@@ -62,21 +80,64 @@ type Stream struct {
 }
 
 type Downloader struct {
-	cache      *lru.Cache
-	httpClient HTTPClient
-	dir        string
-	channel    string
-	out        *os.File
-	fileName   string
-	active     bool
-	notifier   telegram.Notifier
-	started    time.Time
+	ledger      *Ledger
+	httpClient  HTTPClient
+	twitch      api.TwitchAPI
+	usher       api.UsherAPI
+	channelAPI  api.ChannelAPI
+	liveness    liveChecker
+	dir         string
+	channel     string
+	out         *os.File
+	muxer       muxer
+	format      string
+	offset      int64
+	notifier    Notifier
+	quality     Quality
+	workers     int
+	maxBuffered int64
+	expected    uint64
+	tracking    bool
+
+	// sealed files got tracks their init segment lacks and are not continued
+	sealed map[string]bool
+
+	checkInterval    time.Duration
+	downloadInterval time.Duration
+	minRetryDeadline time.Duration
+
+	// guarded by mu
+	mu        sync.Mutex
+	metadata  Metadata
+	fileName  string
+	state     State
+	started   time.Time
+	written   int64
+	size      int64
+	segments  int
+	errors    int
+	lastError string
+}
+
+type Gap struct {
+	Time          time.Time
+	From          uint64
+	To            uint64
+	Lost          time.Duration
+	Discontinuity bool
 }
 
 type Metadata struct {
-	Title  string
-	Author string
-	Date   time.Time
+	Title    string
+	Author   string
+	Date     time.Time
+	Channel  string `json:",omitempty"`
+	StreamID int64  `json:",omitempty"`
+	Game     string `json:",omitempty"`
+	Viewers  int    `json:",omitempty"` // at the start of the recording
+	Gaps     []Gap  `json:",omitempty"`
+	End      time.Time
+	Duration time.Duration `json:",omitempty"`
 }
 
 func ReadMetadata(input io.Reader) (metadata Metadata, err error) {
@@ -93,18 +154,45 @@ func GetMetadataFileName(fileName string) string {
 	return fmt.Sprintf("%s.%s", fileName, metadataExtension)
 }
 
-func getFileName(stream string, time time.Time) string {
-	return fmt.Sprintf("%s-%s.mp4", stream, time.Format("02-01-06"))
+func getFileName(metadata Metadata, format string) string {
+	return fmt.Sprintf("%s.%s", FormatFileName(fileNamePattern, metadata), format)
+}
+
+func (d *Downloader) Notify(message string) {
+	d.emit(Event{Type: EventMessage, Message: message})
 }
 
-func (d Downloader) Notify(message string) {
-	if err := d.notifier.Notify(message); err != nil {
+func (d *Downloader) emit(event Event) {
+	event.Channel = d.channel
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := deliver(d.notifier, event); err != nil {
 		log.Println("notification failed:", err)
 	}
 }
 
-func (d Downloader) getMetadata() (metadata Metadata, err error) {
-	c, err := api.API.Channel(d.channel)
+// recordingEvent returns an event describing the current recording.
+func (d *Downloader) recordingEvent(t EventType, duration time.Duration) Event {
+	d.mu.Lock()
+	metadata := d.metadata
+	metadata.Gaps = append([]Gap(nil), d.metadata.Gaps...)
+	event := Event{
+		Type:     t,
+		Time:     time.Now(),
+		Channel:  d.channel,
+		File:     d.fileName,
+		Duration: duration,
+		Size:     d.size,
+		Metadata: &metadata,
+	}
+	d.mu.Unlock()
+	event.Message = DefaultMessages.Event(event)
+	return event
+}
+
+func (d *Downloader) getMetadata(ctx context.Context) (metadata Metadata, err error) {
+	c, err := d.channelAPI.ChannelContext(ctx, d.channel)
 	if err != nil {
 		return metadata, err
 	}
@@ -114,24 +202,48 @@ func (d Downloader) getMetadata() (metadata Metadata, err error) {
 	metadata.Date = c.Stream.CreatedAt
 	metadata.Author = c.Stream.Data.Name
 	metadata.Title = c.Stream.Data.Status
+	metadata.Channel = d.channel
+	metadata.StreamID = c.Stream.ID
+	metadata.Game = c.Stream.Game
+	metadata.Viewers = c.Stream.Viewers
 
 	return metadata, nil
 }
 
-func (d Downloader) getStream() (stream Stream, err error) {
-	tok, err := api.API.Token(api.TokenLive, d.channel)
+func (d *Downloader) newSession(ctx context.Context) Metadata {
+	metadata, err := d.getMetadata(ctx)
+	if err != nil {
+		log.Println("unable to identify broadcast:", err)
+		metadata = Metadata{Channel: d.channel}
+	}
+	if metadata.Date.IsZero() {
+		metadata.Date = time.Now()
+	}
+	return metadata
+}
+
+func (d *Downloader) getStream(ctx context.Context) (stream Stream, err error) {
+	tok, err := d.twitch.TokenContext(ctx, api.TokenLive, d.channel)
 	if err != nil {
 		return
 	}
-	u := api.Usher.Channel(d.channel, tok.Values())
+	u := d.usher.Channel(d.channel, tok.Values())
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return
 	}
+	req = req.WithContext(ctx)
 	res, err := d.httpClient.Do(req)
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
+	if err := api.CheckResponse(res); err != nil {
+		if errors.Is(err, api.ErrNotFound) {
+			return stream, ErrStreamOffline
+		}
+		return stream, err
+	}
 	p, _, err := m3u8.DecodeFrom(res.Body, true)
 	if err != nil {
 		return stream, ErrStreamOffline
@@ -139,75 +251,179 @@ func (d Downloader) getStream() (stream Stream, err error) {
 	switch p := p.(type) {
 	case *m3u8.MasterPlaylist:
 		{
-			for _, variant := range p.Variants {
-				if variant.Video != targetVideo {
-					continue
-				}
-				stream.URL = variant.URI
-				return stream, nil
+			variant, err := d.quality.Select(p.Variants)
+			if err != nil {
+				return stream, err
 			}
+			log.Println("selected variant", variant.Video, variant.Name, variant.Resolution)
+			stream.Name = variant.Video
+			stream.URL = variant.URI
+			return stream, nil
 		}
 	}
 	return stream, ErrTargetVideoNotFound
 }
 
-func (d Downloader) DownloadChunk(chunkURL string) error {
+func (d *Downloader) DownloadChunk(chunkURL string) (data []byte, err error) {
+	return d.DownloadChunkContext(context.Background(), chunkURL)
+}
+
+func (d *Downloader) DownloadChunkContext(ctx context.Context, chunkURL string) (data []byte, err error) {
 	log.Println("GET", chunkURL)
 	req, err := http.NewRequest("GET", chunkURL, nil)
 	if err != nil {
 		log.Println("new_request err", err)
-		return err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 	res, err := d.httpClient.Do(req)
 	if err != nil {
 		log.Println("HTTP ERR", err)
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
-	if _, err = io.Copy(d.out, res.Body); err != nil {
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, StatusError{URL: chunkURL, StatusCode: res.StatusCode}
+	}
+	if data, err = ioutil.ReadAll(res.Body); err != nil {
 		log.Println("IO ERR", err)
-		return err
+		return nil, err
 	}
+	return data, nil
+}
+
+func (d *Downloader) writeSegment(seq uint64, chunkURL string, data []byte, discontinuity bool, segmentDuration time.Duration) error {
+	d.checkSequence(seq, discontinuity, segmentDuration)
+	offset := d.offset
+	written, err := d.muxer.WriteSegment(data)
+	if err != nil {
+		log.Println("write err", err)
+		return d.rollback(err)
+	}
+	d.offset += written
+	entry := LedgerEntry{Seq: seq, URL: chunkURL, Offset: offset, Size: written}
+	entry.DTS, entry.Time = d.muxer.Position()
+	if err := d.ledger.Append(entry); err != nil {
+		log.Println("ledger append failed:", err)
+		return ErrLedger
+	}
+	d.expected = seq + 1
+	d.tracking = true
+	d.countSegment(written, d.offset)
 	return nil
 }
 
-func (d *Downloader) prepareFile() error {
-	fileName := getFileName(d.channel, time.Now())
+func (d *Downloader) rollback(cause error) error {
+	if err := d.out.Truncate(d.offset); err != nil {
+		return err
+	}
+	if _, err := d.out.Seek(d.offset, io.SeekStart); err != nil {
+		return err
+	}
+	return cause
+}
+
+// resumable reports whether the recording in fileName can be continued. A
+// fragmented MP4 can only be continued with its ledger.
+func (d *Downloader) resumable(fileName string) bool {
+	if d.sealed[fileName] {
+		return false
+	}
+	if d.format != FormatMP4 {
+		return true
+	}
+	stat, err := os.Stat(filepath.Join(d.dir, fileName))
+	if err != nil || stat.Size() == 0 {
+		return true
+	}
+	stat, err = os.Stat(filepath.Join(d.dir, GetLedgerFileName(fileName)))
+	return err == nil && stat.Size() > 0
+}
+
+func (d *Downloader) prepareFile(session Metadata) error {
+	fileName := getFileName(session, d.format)
+	for n := 1; !d.resumable(fileName); n++ {
+		fileName = numberedFileName(getFileName(session, d.format), n)
+	}
 	filePath := filepath.Join(d.dir, fileName)
 	log.Println("filepath:", filePath)
+	d.mu.Lock()
 	d.fileName = fileName
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		f, err := os.Create(filePath)
-		if err != nil {
-			return err
-		}
-		d.out = f
-		return nil
+	d.mu.Unlock()
+	ledger, err := OpenLedger(filepath.Join(d.dir, GetLedgerFileName(fileName)))
+	if err != nil {
+		return err
 	}
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		log.Println("stat err", err)
+		ledger.Close()
 		return err
 	}
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0600)
+	stat, err := f.Stat()
 	if err != nil {
+		log.Println("stat err", err)
+		f.Close()
+		ledger.Close()
+		return err
+	}
+	offset := stat.Size()
+	if ledger.Len() > 0 && ledger.End() <= offset {
+		offset = ledger.End()
+	}
+	if offset != stat.Size() {
+		log.Println("truncating partially written segment:", stat.Size()-offset, "bytes")
+	}
+	if d.muxer, err = newMuxer(d.format, f, ledger); err != nil {
+		f.Close()
+		ledger.Close()
 		return err
 	}
 	d.out = f
-	return nil
+	d.offset = offset
+	d.mu.Lock()
+	d.size = offset
+	d.mu.Unlock()
+	d.ledger = ledger
+	last, ok := ledger.Last()
+	d.expected = last.Seq + 1
+	d.tracking = ok
+	d.loadMetadata(session)
+	return d.rollback(nil)
+}
+
+func (d *Downloader) closeFile() {
+	if err := d.out.Sync(); err != nil {
+		log.Println("sync failed:", err)
+	}
+	if err := d.out.Close(); err != nil {
+		log.Println("close failed:", err)
+	}
+	if err := d.ledger.Close(); err != nil {
+		log.Println("ledger close failed:", err)
+	}
 }
 
-func (d Downloader) DownloadChunks(stream Stream) error {
+func (d *Downloader) DownloadChunks(stream Stream) error {
+	return d.DownloadChunksContext(context.Background(), stream)
+}
+
+// DownloadChunksContext writes the new segments of the media playlist.
+// When ctx is done, segments that are not yet written are skipped.
+func (d *Downloader) DownloadChunksContext(ctx context.Context, stream Stream) error {
 	log.Println("downloading chunks")
 	req, err := http.NewRequest("GET", stream.URL, nil)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	res, err := d.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+	if err := api.CheckResponse(res); err != nil {
+		return err
+	}
 	p, _, err := m3u8.DecodeFrom(res.Body, true)
 	if err != nil {
 		return err
@@ -216,115 +432,329 @@ func (d Downloader) DownloadChunks(stream Stream) error {
 	if err != nil {
 		return err
 	}
+	media, ok := p.(*m3u8.MediaPlaylist)
+	if !ok {
+		return ErrBadPlaylist
+	}
 	var (
-		chunkURL string
+		segmentDuration = averageDuration(media)
+		segments        []segment
+		reset           = d.sequenceReset(media)
 	)
-	switch p := p.(type) {
-	case *m3u8.MediaPlaylist:
-		{
-			for _, segment := range p.Segments {
-				if segment == nil {
-					continue
-				}
-				chunkURL = segment.URI
-				if !strings.HasPrefix(chunkURL, "http") {
-					u, err := playlistURL.Parse(segment.URI)
-					if err != nil {
-						log.Println("parse", err)
-						continue
-					}
-					chunkURL = u.String()
-				}
-				_, hit := d.cache.Get(chunkURL)
-				if hit {
-					continue
-				}
-				if err := d.DownloadChunk(chunkURL); err != nil {
-					d.notify("chunk download error", err)
-				} else {
-					d.cache.Add(chunkURL, nil)
+	for i, s := range media.Segments {
+		if s == nil {
+			continue
+		}
+		seq := media.SeqNo + uint64(i)
+		if d.tracking && !reset && seq < d.expected {
+			// A segment that failed earlier while later ones were written:
+			// its gap is recorded and appending it now would break the order.
+			continue
+		}
+		chunkURL := s.URI
+		if !strings.HasPrefix(chunkURL, "http") {
+			u, err := playlistURL.Parse(s.URI)
+			if err != nil {
+				log.Println("parse", err)
+				continue
+			}
+			chunkURL = u.String()
+		}
+		if d.ledger.Seen(chunkURL) {
+			continue
+		}
+		segments = append(segments, segment{
+			seq:           seq,
+			url:           chunkURL,
+			duration:      segmentDuration,
+			discontinuity: s.Discontinuity,
+		})
+	}
+	var writeErr error
+	deadline := d.segmentDeadline(time.Duration(media.TargetDuration * float64(time.Second)))
+	fetchOrdered(segments, d.workers, d.maxBuffered, d.segmentFetcher(ctx, deadline), func(s fetched) {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.err != nil {
+			d.countError(s.err)
+			d.notify("chunk download error", s.err)
+			return
+		}
+		if writeErr != nil {
+			return
+		}
+		if err := d.writeSegment(s.seq, s.url, s.data, s.discontinuity, s.duration); err != nil {
+			d.countError(err)
+			d.notify("chunk write error", err)
+			if errors.Is(err, mp4.ErrNewTrack) {
+				if d.sealed == nil {
+					d.sealed = make(map[string]bool)
 				}
+				d.sealed[d.fileName] = true
+			}
+			if err == ErrLedger || errors.Is(err, mp4.ErrNewTrack) {
+				writeErr = err
 			}
 		}
-	default:
-		return errors.New("Bad playlist type")
+	})
+	if writeErr != nil {
+		return writeErr
 	}
-	return nil
+	return ctx.Err()
 }
 
-func (d *Downloader) notifyLoop() {
+func averageDuration(p *m3u8.MediaPlaylist) time.Duration {
+	var (
+		total float64
+		count int
+	)
+	for _, segment := range p.Segments {
+		if segment == nil {
+			continue
+		}
+		total += segment.Duration
+		count++
+	}
+	if count == 0 || total == 0 {
+		return time.Duration(p.TargetDuration * float64(time.Second))
+	}
+	return time.Duration(total / float64(count) * float64(time.Second))
+}
+
+// sequenceReset reports whether the playlist ends before the segments
+// already written, so its sequence numbers started over.
+func (d *Downloader) sequenceReset(media *m3u8.MediaPlaylist) bool {
+	if !d.tracking {
+		return false
+	}
+	last := -1
+	for i, s := range media.Segments {
+		if s != nil {
+			last = i
+		}
+	}
+	return last >= 0 && media.SeqNo+uint64(last)+1 < d.expected
+}
+
+func (d *Downloader) checkSequence(seq uint64, discontinuity bool, segmentDuration time.Duration) {
+	now := time.Now()
+	if d.tracking && seq > d.expected {
+		lost := seq - d.expected
+		d.recordGap(Gap{
+			Time: now,
+			From: d.expected,
+			To:   seq - 1,
+			Lost: time.Duration(lost) * segmentDuration,
+		})
+	}
+	if discontinuity || (d.tracking && seq < d.expected) {
+		d.recordGap(Gap{
+			Time:          now,
+			From:          seq,
+			To:            seq,
+			Discontinuity: true,
+		})
+	}
+}
+
+func (d *Downloader) recordGap(gap Gap) {
+	if gap.Discontinuity {
+		log.Println("discontinuity at segment", gap.From)
+	} else {
+		log.Println("segments", gap.From, "-", gap.To, "lost, about", gap.Lost)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metadata.Gaps = append(d.metadata.Gaps, gap)
+	if err := d.saveMetadata(); err != nil {
+		log.Println("metadata write failed:", err)
+	}
+}
+
+func (d *Downloader) gapCount() (count int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.metadata.Gaps)
+}
+
+func (d *Downloader) notifyLoop(ctx context.Context) {
 	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	var (
 		lastNotified time.Time
 	)
-	for t := range ticker.C {
-		if !d.active {
+	for {
+		var t time.Time
+		select {
+		case <-ctx.Done():
 			return
+		case t = <-ticker.C:
+		}
+		status := d.Status()
+		if status.State != StateRecording {
+			lastNotified = time.Time{}
+			continue
+		}
+		if lastNotified.IsZero() {
+			lastNotified = status.Started
 		}
-		duration := t.Sub(d.started)
+		duration := t.Sub(status.Started)
 		if t.Sub(lastNotified) < notificationInterval {
 			continue
 		}
-		d.Notify(fmt.Sprintf("Идет запись канала %s; Продолжительность: %s", d.channel, duration))
+		d.emit(d.recordingEvent(EventProgress, duration))
 		lastNotified = t
 	}
 }
 
 func (d *Downloader) Download(stream Stream) error {
+	return d.DownloadContext(context.Background(), stream)
+}
+
+// DownloadContext records the stream until the playlist is gone or ctx is
+// done.
+func (d *Downloader) DownloadContext(ctx context.Context, stream Stream) error {
 	log.Println("start of record")
-	d.Notify(fmt.Sprintf("Начата запись для канала %s", d.channel))
+	previous, started, err := d.startRecording()
+	if err != nil {
+		return err
+	}
+	defer d.setState(previous)
 	defer log.Println("end of record")
-	if err := d.prepareFile(); err != nil {
+	if err := d.prepareFile(d.newSession(ctx)); err != nil {
+		d.setState(StateFinalizing)
 		return err
 	}
-	defer d.out.Close()
-	ticker := time.NewTicker(downloadInterval)
-	d.active = true
-	d.started = time.Now()
+	d.emit(d.recordingEvent(EventStarted, 0))
+	ticker := time.NewTicker(d.downloadInterval)
+	defer ticker.Stop()
 	defer func() {
-		d.active = false
-		duration := time.Now().Sub(d.started)
-		d.started = time.Time{}
-		d.Notify(fmt.Sprintf("Запись для канала %s завершена; Продолжительность: %s", d.channel, duration))
+		d.setState(StateFinalizing)
+		end := time.Now()
+		duration := end.Sub(started)
+		d.finishMetadata(end, duration)
+		d.closeFile()
+		d.emit(d.recordingEvent(EventFinished, duration))
 	}()
-	for _ = range ticker.C {
-		if err := d.DownloadChunks(stream); err != nil {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if err := d.DownloadChunksContext(ctx, stream); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 	}
-	return nil
 }
 
-func (d *Downloader) writeMetadata(metadata Metadata) (err error) {
-	metadataPath := path.Join(d.dir, GetMetadataFileName(d.fileName))
+func (d *Downloader) metadataPath() string {
+	return path.Join(d.dir, GetMetadataFileName(d.fileName))
+}
+
+func (d *Downloader) loadMetadata(session Metadata) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metadata = session
+	f, err := os.Open(d.metadataPath())
+	if os.IsNotExist(err) {
+		if err := d.saveMetadata(); err != nil {
+			log.Println("metadata write failed:", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Println("metadata open failed:", err)
+		return
+	}
+	defer f.Close()
+	metadata, err := ReadMetadata(f)
+	if err != nil {
+		log.Println("metadata read failed:", err)
+		return
+	}
+	d.metadata = metadata
+}
+
+// saveMetadata replaces the metadata file through a synced temporary
+// file, so a crash leaves either the old or the new metadata on disk.
+func (d *Downloader) saveMetadata() (err error) {
+	metadataPath := d.metadataPath()
 	log.Println("writing metadata to file:", metadataPath)
-	f, err := os.Create(metadataPath)
+	tmp := metadataPath + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return WriteMetadata(f, metadata)
+	if err := WriteMetadata(f, d.metadata); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, metadataPath)
+}
+
+func (d *Downloader) writeMetadata(metadata Metadata) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	metadata.Gaps = d.metadata.Gaps
+	metadata.End = d.metadata.End
+	metadata.Duration = d.metadata.Duration
+	d.metadata = metadata
+	return d.saveMetadata()
+}
+
+// finishMetadata records when the recording stopped and adds the session
+// to the recorded duration.
+func (d *Downloader) finishMetadata(end time.Time, session time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metadata.End = end
+	d.metadata.Duration += session
+	if err := d.saveMetadata(); err != nil {
+		log.Println("metadata write failed:", err)
+	}
 }
 
-func (d *Downloader) metadataLoop() {
-	ticker := time.NewTicker(checkInterval)
+func (d *Downloader) metadataLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.checkInterval)
+	defer ticker.Stop()
 	var (
 		metadataSaved = false
 	)
-	for _ = range ticker.C {
-		if !d.active {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if d.Status().State != StateRecording {
 			metadataSaved = false
 			continue
 		}
 		if metadataSaved {
 			continue
 		}
-		metadata, err := d.getMetadata()
+		metadata, err := d.getMetadata(ctx)
 		if err == ErrStreamOffline {
 			continue
 		}
 		if err != nil {
 			log.Println("metatada get failed:", err)
+			continue
 		}
 		if err := d.writeMetadata(metadata); err != nil {
 			log.Println("metadata write failed:", err)
@@ -334,40 +764,99 @@ func (d *Downloader) metadataLoop() {
 	}
 }
 
-func (d *Downloader) notify(v ...interface{}) {
-	s := fmt.Sprintln(v...)
-	log.Print(s)
-	d.Notify(s)
+func (d *Downloader) notify(what string, err error) {
+	log.Println(d.channel, what+":", err)
+	event := Event{Type: EventError, Channel: d.channel, Error: what + ": " + err.Error(), Fatal: fatal(err)}
+	event.Message = DefaultMessages.Event(event)
+	d.emit(event)
 }
 
-func (d *Downloader) loop() {
-	ticker := time.NewTicker(checkInterval)
+func retryAfter(err error, fallback time.Duration) time.Duration {
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	return fallback
+}
+
+func (d *Downloader) loop(ctx context.Context) {
+	ticker := time.NewTicker(d.checkInterval)
+	defer ticker.Stop()
 	var (
 		errorCount int
 		lastError  error
+		missing    bool
+		online     bool
 	)
-	for _ = range ticker.C {
+	d.setState(StateWaiting)
+	defer d.setState(StateIdle)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		if errorCount > maxErrors {
 			d.notify("error", lastError)
 			errorCount = 0
 		}
-		stream, err := d.getStream()
+		if d.liveness != nil {
+			live, err := d.liveness.IsLiveContext(ctx, d.channel)
+			if err == nil && !live {
+				errorCount = 0
+				lastError = ErrStreamOffline
+				online = false
+				continue
+			}
+		}
+		stream, err := d.getStream(ctx)
 		if err == ErrStreamOffline {
 			errorCount = 0
 			lastError = ErrStreamOffline
+			missing = false
+			online = false
 			continue
 		}
+		if errors.Is(err, api.ErrNotFound) {
+			if !missing {
+				d.notify("channel does not exist", err)
+				missing = true
+			}
+			continue
+		}
+		if errors.Is(err, api.ErrRateLimited) {
+			delay := retryAfter(err, d.checkInterval)
+			log.Println("rate limited, waiting", delay)
+			sleepContext(ctx, delay)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
+			if errors.Is(err, api.ErrServer) {
+				log.Println("twitch is unavailable:", err)
+			}
 			errorCount++
 			lastError = err
+			d.countError(err)
 			continue
 		}
-		if err := d.Download(stream); err != nil {
-			if strings.HasPrefix(err.Error(), "#EXT3MU absent") {
+		missing = false
+		if !online {
+			d.emit(Event{Type: EventOnline})
+			online = true
+		}
+		if err := d.DownloadContext(ctx, stream); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if strings.HasPrefix(err.Error(), "#EXT3MU absent") || errors.Is(err, api.ErrNotFound) {
 				continue
 			}
 			lastError = err
 			errorCount++
+			d.countError(err)
 		} else {
 			errorCount = 0
 		}
@@ -375,30 +864,91 @@ func (d *Downloader) loop() {
 }
 
 func (d *Downloader) Start() {
-	go d.metadataLoop()
-	go d.notifyLoop()
-	d.loop()
+	d.StartContext(context.Background())
+}
+
+// StartContext watches the channel and records its broadcasts until ctx is
+// done.
+func (d *Downloader) StartContext(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		d.metadataLoop(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		d.notifyLoop(ctx)
+	}()
+	d.loop(ctx)
+	wg.Wait()
 }
 
-func New(name string, client HTTPClient) *Downloader {
+func newTwitchAPI(client HTTPClient) api.TwitchAPI {
+	twitch, err := api.NewTwitchAPI(client, apiURL)
+	if err != nil {
+		log.Fatalln("bad api url:", apiURL)
+	}
+	return twitch
+}
+
+func newUsherAPI() api.UsherAPI {
+	usher, err := api.NewUsherAPI(usherURL)
+	if err != nil {
+		log.Fatalln("bad usher url:", usherURL)
+	}
+	return usher
+}
+
+// newAPIs returns the API clients for client. With a client secret every
+// API request carries one shared app access token.
+func newAPIs(client HTTPClient) (api.TwitchAPI, api.ChannelAPI) {
+	if len(clientSecret) > 0 {
+		if len(clientID) == 0 {
+			log.Fatalln("-client-secret requires -client-id")
+		}
+		client = api.NewCredentials(client, clientID, clientSecret).Client(client)
+	}
+	twitch := newTwitchAPI(client)
+	if len(clientID) == 0 {
+		return twitch, twitch
+	}
+	return twitch, twitch.Helix(clientID)
+}
+
+func New(name string, client HTTPClient, notifier Notifier) *Downloader {
+	twitch, channelAPI := newAPIs(client)
+	return newDownloader(name, client, notifier, twitch, channelAPI)
+}
+
+func newDownloader(name string, client HTTPClient, notifier Notifier, twitch api.TwitchAPI, channelAPI api.ChannelAPI) *Downloader {
 	d := new(Downloader)
 	d.channel = name
-	d.cache = lru.New(maxCacheEntries)
 	d.httpClient = client
+	d.twitch = twitch
+	d.usher = newUsherAPI()
+	d.channelAPI = channelAPI
+	if helix, ok := d.channelAPI.(api.Helix); ok {
+		d.liveness = helix
+	}
 	d.dir = workdir
-	if len(telegramToken) == 0 {
-		log.Fatalln("no token provided")
-	}
-	d.notifier = telegram.New(telegramToken, chatRoom)
-	d.notifier.Handle("/status", func(event string, args []string, chat int) {
-		log.Println("got status request", event, args, chat)
-		if !d.active {
-			d.notifier.Notify("Запись не ведется")
-		} else {
-			d.notifier.Notify(fmt.Sprintf("Записываю уже %s", time.Now().Sub(d.started)))
-		}
-
-	})
-
+	d.notifier = notifier
+	if d.notifier == nil {
+		d.notifier = LogNotifier{}
+	}
+	q, err := ParseQuality(quality)
+	if err != nil {
+		log.Fatalln("bad quality:", quality)
+	}
+	d.quality = q
+	if err := checkFormat(format); err != nil {
+		log.Fatalln("bad format:", format)
+	}
+	d.format = format
+	d.workers = workers
+	d.maxBuffered = maxBuffered
+	d.checkInterval = checkInterval
+	d.downloadInterval = downloadInterval
+	d.minRetryDeadline = minRetryDeadline
 	return d
 }
@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGaps(t *testing.T) {
+	Convey("Gaps", t, func() {
+		dir, err := ioutil.TempDir("", "gaps")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		d := &Downloader{dir: dir, fileName: "test.mp4"}
+
+		Convey("First segment", func() {
+			d.checkSequence(100, false, 2*time.Second)
+			So(d.gapCount(), ShouldEqual, 0)
+		})
+		Convey("Skipped range", func() {
+			d.expected, d.tracking = 100, true
+			d.checkSequence(103, false, 2*time.Second)
+			So(d.gapCount(), ShouldEqual, 1)
+			gap := d.metadata.Gaps[0]
+			So(gap.From, ShouldEqual, 100)
+			So(gap.To, ShouldEqual, 102)
+			So(gap.Lost, ShouldEqual, 6*time.Second)
+
+			f, err := os.Open(d.metadataPath())
+			So(err, ShouldBeNil)
+			defer f.Close()
+			metadata, err := ReadMetadata(f)
+			So(err, ShouldBeNil)
+			So(len(metadata.Gaps), ShouldEqual, 1)
+		})
+		Convey("Discontinuity", func() {
+			d.expected, d.tracking = 100, true
+			d.checkSequence(100, true, 2*time.Second)
+			So(d.gapCount(), ShouldEqual, 1)
+			So(d.metadata.Gaps[0].Discontinuity, ShouldBeTrue)
+		})
+		Convey("Metadata keeps gaps", func() {
+			d.expected, d.tracking = 100, true
+			d.checkSequence(101, false, 2*time.Second)
+			So(d.writeMetadata(Metadata{Title: "title"}), ShouldBeNil)
+			So(d.gapCount(), ShouldEqual, 1)
+			So(d.metadata.Title, ShouldEqual, "title")
+		})
+	})
+}
+
+func TestFileName(t *testing.T) {
+	Convey("FileName", t, func() {
+		start := time.Date(2015, 8, 10, 21, 30, 0, 0, time.UTC)
+		metadata := Metadata{
+			Channel:  "cauthontv",
+			StreamID: 15938593,
+			Title:    "Dota 2: ranked / party?",
+			Game:     "Dota 2",
+			Date:     start,
+		}
+		So(FormatFileName(defaultFileNamePattern, metadata), ShouldEqual, "cauthontv-15938593")
+		So(FormatFileName("../{channel}/{id}", metadata), ShouldEqual, ".._cauthontv_15938593")
+		So(FormatFileName("{channel}-{id}-{game}-{title}", metadata), ShouldEqual, "cauthontv-15938593-Dota 2-Dota 2_ ranked _ party_")
+		metadata.StreamID = 0
+		So(FormatFileName("{channel}-{id}", metadata), ShouldEqual, "cauthontv-2015-08-10_21-30-00")
+	})
+}
@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultFileNamePattern = "{channel}-{id}"
+	fileNameTimeLayout     = "2006-01-02_15-04-05"
+	maxPlaceholderLength   = 64
+)
+
+func sanitizeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(strings.TrimSpace(s), ".")
+	if runes := []rune(s); len(runes) > maxPlaceholderLength {
+		s = strings.TrimSpace(string(runes[:maxPlaceholderLength]))
+	}
+	return s
+}
+
+// FormatFileName expands {channel}, {id}, {title}, {game} and {start}
+// placeholders of the pattern with the recording metadata.
+// When the broadcast id is unknown, {id} falls back to the start time.
+// Path separators in the pattern are replaced, so the file always stays in
+// the working directory.
+func FormatFileName(pattern string, metadata Metadata) string {
+	pattern = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, pattern)
+	start := metadata.Date.Format(fileNameTimeLayout)
+	id := start
+	if metadata.StreamID != 0 {
+		id = strconv.FormatInt(metadata.StreamID, 10)
+	}
+	r := strings.NewReplacer(
+		"{channel}", sanitizeFileName(metadata.Channel),
+		"{id}", id,
+		"{title}", sanitizeFileName(metadata.Title),
+		"{game}", sanitizeFileName(metadata.Game),
+		"{start}", start,
+	)
+	return r.Replace(pattern)
+}
+
+// numberedFileName returns the n-th alternative name for a recording that
+// can not be continued, like "name-1.mp4".
+func numberedFileName(fileName string, n int) string {
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(fileName, ext), n, ext)
+}
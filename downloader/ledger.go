@@ -0,0 +1,129 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/golang/groupcache/lru"
+)
+
+const ledgerExtension = "ledger"
+
+type LedgerEntry struct {
+	Seq    uint64 `json:"seq"`
+	URL    string `json:"url"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	DTS    uint64 `json:"dts,omitempty"`
+	Time   uint64 `json:"time,omitempty"`
+}
+
+// Ledger is an append-only journal of segments written to a recording,
+// one JSON object per line. It survives restarts so that segments still in
+// the live window are not written twice.
+type Ledger struct {
+	f     *os.File
+	cache *lru.Cache
+	seqs  map[uint64]bool
+	last  LedgerEntry
+	count int
+}
+
+func GetLedgerFileName(fileName string) string {
+	return fmt.Sprintf("%s.%s", fileName, ledgerExtension)
+}
+
+func OpenLedger(name string) (*Ledger, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Ledger{f: f, cache: lru.New(maxCacheEntries), seqs: make(map[uint64]bool)}
+	var (
+		valid  int64
+		reader = bufio.NewReader(f)
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			log.Println("ledger: skipping corrupted tail of", name, err)
+			break
+		}
+		valid += int64(len(line))
+		l.add(entry)
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Ledger) add(entry LedgerEntry) {
+	l.cache.Add(entry.URL, nil)
+	l.seqs[entry.Seq] = true
+	l.last = entry
+	l.count++
+}
+
+func (l *Ledger) Seen(url string) bool {
+	_, hit := l.cache.Get(url)
+	return hit
+}
+
+// Written reports whether the segment with the sequence number is in the
+// ledger.
+func (l *Ledger) Written(seq uint64) bool {
+	return l.seqs[seq]
+}
+
+func (l *Ledger) Last() (entry LedgerEntry, ok bool) {
+	return l.last, l.count > 0
+}
+
+func (l *Ledger) Len() int {
+	return l.count
+}
+
+// End returns the offset in the recording right after the last
+// segment known to be completely written.
+func (l *Ledger) End() int64 {
+	return l.last.Offset + l.last.Size
+}
+
+func (l *Ledger) Append(entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.add(entry)
+	return nil
+}
+
+func (l *Ledger) Close() error {
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLedger(t *testing.T) {
+	Convey("Ledger", t, func() {
+		dir, err := ioutil.TempDir("", "ledger")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, GetLedgerFileName("test.mp4"))
+
+		l, err := OpenLedger(name)
+		So(err, ShouldBeNil)
+		_, ok := l.Last()
+		So(ok, ShouldBeFalse)
+		So(l.Append(LedgerEntry{Seq: 10, URL: "a", Offset: 0, Size: 100}), ShouldBeNil)
+		So(l.Append(LedgerEntry{Seq: 11, URL: "b", Offset: 100, Size: 50}), ShouldBeNil)
+		So(l.Close(), ShouldBeNil)
+
+		Convey("Reopen", func() {
+			l, err := OpenLedger(name)
+			So(err, ShouldBeNil)
+			defer l.Close()
+			So(l.Len(), ShouldEqual, 2)
+			So(l.End(), ShouldEqual, 150)
+			So(l.Seen("a"), ShouldBeTrue)
+			So(l.Seen("c"), ShouldBeFalse)
+			last, ok := l.Last()
+			So(ok, ShouldBeTrue)
+			So(last.Seq, ShouldEqual, 11)
+		})
+		Convey("Corrupted tail", func() {
+			f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0600)
+			So(err, ShouldBeNil)
+			f.WriteString(`{"seq": 12, "url": "c", "off`)
+			f.Close()
+
+			l, err := OpenLedger(name)
+			So(err, ShouldBeNil)
+			So(l.Len(), ShouldEqual, 2)
+			So(l.Append(LedgerEntry{Seq: 12, URL: "c", Offset: 150, Size: 10}), ShouldBeNil)
+			So(l.Close(), ShouldBeNil)
+
+			l, err = OpenLedger(name)
+			So(err, ShouldBeNil)
+			defer l.Close()
+			So(l.Len(), ShouldEqual, 3)
+			So(l.End(), ShouldEqual, 160)
+		})
+	})
+}
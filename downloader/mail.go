@@ -0,0 +1,230 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDigestErrors limits how many errors are listed in one digest.
+	maxDigestErrors = 50
+	mailTimeout     = 30 * time.Second
+)
+
+// Mail sends a daily digest of finished recordings and errors over SMTP and
+// mails fatal errors right away, once per channel and error until the next
+// digest. Plain messages are left to chat notifiers.
+type Mail struct {
+	addr    string
+	auth    smtp.Auth
+	from    string
+	to      []string
+	timeout time.Duration
+	send    func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	now     func() time.Time
+	alerts  sync.WaitGroup
+
+	mu       sync.Mutex
+	finished []Event
+	errors   []Event
+	alerted  map[string]bool
+}
+
+// NewMail returns a mail notifier for the SMTP server at addr (host:port).
+// auth may be nil.
+func NewMail(addr string, auth smtp.Auth, from string, to []string) *Mail {
+	m := &Mail{
+		addr:    addr,
+		auth:    auth,
+		from:    from,
+		to:      to,
+		timeout: mailTimeout,
+		now:     time.Now,
+		alerted: make(map[string]bool),
+	}
+	m.send = m.sendMail
+	return m
+}
+
+// sendMail is smtp.SendMail with a deadline for the whole conversation, so
+// a hanging server can not hold a mail forever.
+func (m *Mail) sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, m.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(m.timeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *Mail) Notify(string) error {
+	return nil
+}
+
+func (m *Mail) NotifyEvent(event Event) error {
+	key := event.Channel + "\x00" + event.Error
+	m.mu.Lock()
+	switch event.Type {
+	case EventFinished:
+		m.finished = append(m.finished, event)
+	case EventError:
+		m.errors = append(m.errors, event)
+	}
+	alert := event.Type == EventError && event.Fatal && !m.alerted[key]
+	if alert {
+		m.alerted[key] = true
+	}
+	m.mu.Unlock()
+	if !alert {
+		return nil
+	}
+	data := DefaultMessages.Data(event)
+	subject, body := DefaultMessages.Text(MessageFatalSubject, data), DefaultMessages.Text(MessageFatalBody, data)
+	m.alerts.Add(1)
+	go func() {
+		defer m.alerts.Done()
+		if err := m.mail(subject, body); err != nil {
+			log.Println("fatal error mail failed:", err)
+		}
+	}()
+	return nil
+}
+
+// Wait blocks until the fatal error mails in flight are sent.
+func (m *Mail) Wait() {
+	m.alerts.Wait()
+}
+
+// Pending reports whether anything is waiting for the next digest.
+func (m *Mail) Pending() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.finished) > 0 || len(m.errors) > 0
+}
+
+// SendDigest mails everything collected since the last digest as the
+// digest for day. Nothing is sent when nothing happened; on failure the
+// events are kept for the next attempt.
+func (m *Mail) SendDigest(day time.Time) error {
+	m.mu.Lock()
+	finished, errs := m.finished, m.errors
+	m.finished, m.errors = nil, nil
+	m.mu.Unlock()
+	if len(finished) == 0 && len(errs) == 0 {
+		return nil
+	}
+	data := digest(day, finished, errs)
+	err := m.mail(DefaultMessages.Text(MessageDigestSubject, data), DefaultMessages.Text(MessageDigestBody, data))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.finished = append(finished, m.finished...)
+		m.errors = append(errs, m.errors...)
+		return err
+	}
+	m.alerted = make(map[string]bool)
+	return nil
+}
+
+func digest(day time.Time, finished, errs []Event) DigestData {
+	data := DigestData{Day: day, ErrorCount: len(errs)}
+	for _, e := range finished {
+		data.Recordings = append(data.Recordings, DefaultMessages.Data(e))
+	}
+	for i, e := range errs {
+		if i == maxDigestErrors {
+			data.More = len(errs) - maxDigestErrors
+			break
+		}
+		data.Errors = append(data.Errors, DefaultMessages.Data(e))
+	}
+	return data
+}
+
+func (m *Mail) mail(subject, body string) error {
+	var msg bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, v)
+	}
+	header("From", m.from)
+	header("To", strings.Join(m.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", m.now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	w.Close()
+	return m.send(m.addr, m.auth, m.from, m.to, msg.Bytes())
+}
+
+func nextMidnight(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	return time.Date(y, mo, d+1, 0, 0, 0, 0, t.Location())
+}
+
+// Run sends the digest every midnight until ctx is done.
+func (m *Mail) Run(ctx context.Context) {
+	for {
+		day := m.now()
+		timer := time.NewTimer(nextMidnight(day).Sub(day))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := m.SendDigest(day); err != nil {
+			log.Println("digest mail failed:", err)
+		}
+	}
+}
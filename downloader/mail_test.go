@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// smtpServer is a minimal SMTP stand-in that keeps received messages.
+type smtpServer struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []*mail.Message
+	rcpt     []string
+}
+
+func newSMTPServer() *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+	s := &smtpServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(textproto.NewConn(conn))
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 localhost ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "RCPT":
+			s.mu.Lock()
+			s.rcpt = append(s.rcpt, line)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := ioutil.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+			if err != nil {
+				c.PrintfLine("554 bad message")
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smtpServer) Close() {
+	s.ln.Close()
+}
+
+func readMail(msg *mail.Message) (subject, body string) {
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	So(err, ShouldBeNil)
+	So(msg.Header.Get("Content-Transfer-Encoding"), ShouldEqual, "quoted-printable")
+	data, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	So(err, ShouldBeNil)
+	return subject, string(data)
+}
+
+func TestMail(t *testing.T) {
+	Convey("Mail", t, func() {
+		srv := newSMTPServer()
+		defer srv.Close()
+		m := NewMail(srv.Addr(), nil, "recorder@example.com", []string{"team@example.com"})
+		day := time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+		m.now = func() time.Time { return day }
+
+		Convey("Digest", func() {
+			So(m.SendDigest(day), ShouldBeNil)
+			So(srv.messages, ShouldBeEmpty)
+
+			So(m.NotifyEvent(Event{Type: EventStarted, Channel: "streamer"}), ShouldBeNil)
+			So(m.NotifyEvent(Event{
+				Type:     EventFinished,
+				Channel:  "streamer",
+				File:     "streamer.ts",
+				Duration: 90 * time.Minute,
+				Size:     3 << 29,
+				Metadata: &Metadata{Title: "title", Game: "game", Gaps: []Gap{{From: 5, To: 7}}},
+			}), ShouldBeNil)
+			So(m.NotifyEvent(Event{
+				Type:    EventError,
+				Time:    day.Add(-time.Hour),
+				Channel: "other",
+				Error:   "chunk download error",
+			}), ShouldBeNil)
+			So(srv.messages, ShouldBeEmpty)
+			So(m.Pending(), ShouldBeTrue)
+
+			So(m.SendDigest(day), ShouldBeNil)
+			So(m.Pending(), ShouldBeFalse)
+			So(len(srv.messages), ShouldEqual, 1)
+			So(srv.rcpt, ShouldResemble, []string{"RCPT TO:<team@example.com>"})
+			subject, body := readMail(srv.messages[0])
+			So(subject, ShouldEqual, "Записи за 2020-01-02")
+			So(body, ShouldContainSubstring, "Завершено записей: 1")
+			So(body, ShouldContainSubstring, "streamer: title")
+			So(body, ShouldContainSubstring, "Продолжительность: 1 ч 30 мин")
+			So(body, ShouldContainSubstring, "Размер: 1.5 GiB")
+			So(body, ShouldContainSubstring, "Пропусков: 1")
+			So(body, ShouldContainSubstring, "22:00:00 other: chunk download error")
+		})
+		Convey("Fatal", func() {
+			So(m.NotifyEvent(Event{
+				Type:    EventError,
+				Channel: "streamer",
+				Error:   ErrLedger.Error(),
+				Fatal:   true,
+			}), ShouldBeNil)
+			m.Wait()
+			So(len(srv.messages), ShouldEqual, 1)
+			subject, body := readMail(srv.messages[0])
+			So(subject, ShouldEqual, "Критическая ошибка на канале streamer")
+			So(body, ShouldContainSubstring, ErrLedger.Error())
+			So(m.Pending(), ShouldBeTrue)
+		})
+		Convey("Fatal once per channel and error", func() {
+			var (
+				mu   sync.Mutex
+				sent []string
+			)
+			release := make(chan struct{})
+			m.send = func(_ string, _ smtp.Auth, _ string, _ []string, msg []byte) error {
+				<-release
+				mu.Lock()
+				sent = append(sent, string(msg))
+				mu.Unlock()
+				return nil
+			}
+			full := Event{Type: EventError, Channel: "streamer", Error: "no space left on device", Fatal: true}
+			for i := 0; i < 3; i++ {
+				So(m.NotifyEvent(full), ShouldBeNil)
+			}
+			other := full
+			other.Channel = "other"
+			So(m.NotifyEvent(other), ShouldBeNil)
+			close(release)
+			m.Wait()
+			So(len(sent), ShouldEqual, 2)
+
+			So(m.SendDigest(day), ShouldBeNil)
+			So(m.NotifyEvent(full), ShouldBeNil)
+			m.Wait()
+			So(len(sent), ShouldEqual, 4)
+		})
+		Convey("Timeout", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err == nil {
+					defer conn.Close()
+					ioutil.ReadAll(conn)
+				}
+			}()
+			m = NewMail(ln.Addr().String(), nil, "recorder@example.com", []string{"team@example.com"})
+			m.timeout = 50 * time.Millisecond
+			So(m.NotifyEvent(Event{Type: EventFinished, Channel: "streamer"}), ShouldBeNil)
+			start := time.Now()
+			So(m.SendDigest(day), ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+		Convey("Keep on failure", func() {
+			m.send = func(string, smtp.Auth, string, []string, []byte) error {
+				return errors.New("unavailable")
+			}
+			So(m.NotifyEvent(Event{Type: EventFinished, Channel: "streamer"}), ShouldBeNil)
+			So(m.SendDigest(day), ShouldNotBeNil)
+			So(m.Pending(), ShouldBeTrue)
+		})
+		Convey("Midnight", func() {
+			So(nextMidnight(day), ShouldResemble, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC))
+		})
+	})
+	Convey("Fatal errors", t, func() {
+		So(fatal(ErrLedger), ShouldBeTrue)
+		So(fatal(ErrStreamOffline), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrUnknownLanguage = errors.New("Unknown message language")
+	ErrUnknownMessage  = errors.New("Unknown message key")
+)
+
+// Message keys. Event messages are keyed by event type and rendered with
+// MessageData; the digest ones get DigestData and "status.api" the number
+// of API requests left.
+const (
+	MessageChannel       = "label.channel"
+	MessageTitle         = "label.title"
+	MessageGame          = "label.game"
+	MessageDuration      = "label.duration"
+	MessageSize          = "label.size"
+	MessageFatalSubject  = "fatal.subject"
+	MessageFatalBody     = "fatal.body"
+	MessageDigestSubject = "digest.subject"
+	MessageDigestBody    = "digest.body"
+	MessageStatusIdle    = "status.idle"
+	MessageStatusActive  = "status.recording"
+	MessageStatusEmpty   = "status.empty"
+	MessageStatusAPI     = "status.api"
+)
+
+// units are the day, hour, minute and second suffixes of a Duration.
+type units [4]string
+
+type catalog struct {
+	units    units
+	messages map[string]string
+}
+
+var catalogs = map[string]catalog{
+	"en": {
+		units: units{"d", "h", "m", "s"},
+		messages: map[string]string{
+			string(EventOnline):   "{{.Channel}} is live",
+			string(EventStarted):  "Started recording {{.Channel}}",
+			string(EventProgress): "Still recording {{.Channel}}; Duration: {{.Duration}}",
+			string(EventFinished): "Finished recording {{.Channel}}; Duration: {{.Duration}}",
+			string(EventError):    "Error on {{.Channel}}: {{.Error}}",
+
+			MessageChannel:  "Channel",
+			MessageTitle:    "Title",
+			MessageGame:     "Game",
+			MessageDuration: "Duration",
+			MessageSize:     "Size",
+
+			MessageFatalSubject: "Fatal error on {{.Channel}}",
+			MessageFatalBody: `Channel: {{.Channel}}
+Time: {{.Time.Format "Mon, 02 Jan 2006 15:04:05 -0700"}}
+Error: {{.Error}}
+{{if .File}}File: {{.File}}
+{{end}}`,
+			MessageDigestSubject: `Recordings for {{.Day.Format "2006-01-02"}}`,
+			MessageDigestBody: `Recordings finished: {{len .Recordings}}
+{{range .Recordings}}
+{{.Channel}}{{if .Title}}: {{.Title}}{{end}}
+{{if .Game}}  Game: {{.Game}}
+{{end}}  File: {{.File}}
+  Duration: {{.Duration}}
+  Size: {{.Size}}
+  Gaps: {{.Gaps}}
+{{end}}{{if .Errors}}
+Errors: {{.ErrorCount}}
+{{range .Errors}}{{.Time.Format "15:04:05"}} {{.Channel}}: {{.Error}}
+{{end}}{{if .More}}... and {{.More}} more
+{{end}}{{end}}`,
+
+			MessageStatusIdle:   "{{.Channel}}: not recording",
+			MessageStatusActive: "{{.Channel}}: recording for {{.Duration}}; Gaps: {{.Gaps}}",
+			MessageStatusEmpty:  "No channels to record",
+			MessageStatusAPI:    "API requests left: {{.}}",
+		},
+	},
+	"ru": {
+		units: units{" д", " ч", " мин", " с"},
+		messages: map[string]string{
+			string(EventOnline):   "Канал {{.Channel}} в эфире",
+			string(EventStarted):  "Начата запись для канала {{.Channel}}",
+			string(EventProgress): "Идет запись канала {{.Channel}}; Продолжительность: {{.Duration}}",
+			string(EventFinished): "Запись для канала {{.Channel}} завершена; Продолжительность: {{.Duration}}",
+			string(EventError):    "Ошибка на канале {{.Channel}}: {{.Error}}",
+
+			MessageChannel:  "Канал",
+			MessageTitle:    "Название",
+			MessageGame:     "Игра",
+			MessageDuration: "Продолжительность",
+			MessageSize:     "Размер",
+
+			MessageFatalSubject: "Критическая ошибка на канале {{.Channel}}",
+			MessageFatalBody: `Канал: {{.Channel}}
+Время: {{.Time.Format "Mon, 02 Jan 2006 15:04:05 -0700"}}
+Ошибка: {{.Error}}
+{{if .File}}Файл: {{.File}}
+{{end}}`,
+			MessageDigestSubject: `Записи за {{.Day.Format "2006-01-02"}}`,
+			MessageDigestBody: `Завершено записей: {{len .Recordings}}
+{{range .Recordings}}
+{{.Channel}}{{if .Title}}: {{.Title}}{{end}}
+{{if .Game}}  Игра: {{.Game}}
+{{end}}  Файл: {{.File}}
+  Продолжительность: {{.Duration}}
+  Размер: {{.Size}}
+  Пропусков: {{.Gaps}}
+{{end}}{{if .Errors}}
+Ошибок: {{.ErrorCount}}
+{{range .Errors}}{{.Time.Format "15:04:05"}} {{.Channel}}: {{.Error}}
+{{end}}{{if .More}}... и еще {{.More}}
+{{end}}{{end}}`,
+
+			MessageStatusIdle:   "{{.Channel}}: запись не ведется",
+			MessageStatusActive: "{{.Channel}}: записываю уже {{.Duration}}; Пропусков: {{.Gaps}}",
+			MessageStatusEmpty:  "Нет каналов для записи",
+			MessageStatusAPI:    "Запросов к API доступно: {{.}}",
+		},
+	},
+}
+
+// DefaultMessages renders every notification text.
+var DefaultMessages = MustMessages("ru", nil)
+
+// Duration prints as a human readable duration like "1h 30m".
+type Duration struct {
+	time.Duration
+	units units
+}
+
+func (d Duration) String() string {
+	u := d.units
+	if len(u[0]) == 0 {
+		u = catalogs["en"].units
+	}
+	v := d.Duration
+	if v < 0 {
+		v = 0
+	}
+	values := [4]int64{
+		int64(v / (24 * time.Hour)),
+		int64(v % (24 * time.Hour) / time.Hour),
+		int64(v % time.Hour / time.Minute),
+		int64(v % time.Minute / time.Second),
+	}
+	for i, n := range values {
+		if n == 0 {
+			continue
+		}
+		s := fmt.Sprintf("%d%s", n, u[i])
+		if i+1 < len(values) && values[i+1] > 0 {
+			s += fmt.Sprintf(" %d%s", values[i+1], u[i+1])
+		}
+		return s
+	}
+	return "0" + u[3]
+}
+
+// Size prints as a file size like "1.5 GiB".
+type Size int64
+
+func (s Size) String() string {
+	return formatSize(int64(s))
+}
+
+// MessageData is what event, fatal and status templates can refer to.
+type MessageData struct {
+	Type     EventType
+	Time     time.Time
+	Channel  string
+	Title    string
+	Game     string
+	Viewers  int // {{.Viewers}}, zero when the event has no metadata
+	File     string
+	Duration Duration
+	Size     Size
+	Gaps     int
+	Error    string
+}
+
+// DigestData is what digest templates can refer to.
+type DigestData struct {
+	Day        time.Time
+	Recordings []MessageData
+	Errors     []MessageData
+	ErrorCount int
+	More       int
+}
+
+// Messages is a set of text/template notification texts in one language.
+type Messages struct {
+	units     units
+	templates *template.Template
+	builtin   *template.Template
+}
+
+func parseMessages(messages map[string]string) (*template.Template, error) {
+	t := template.New("")
+	for key, text := range messages {
+		if _, err := t.New(key).Parse(text); err != nil {
+			return nil, fmt.Errorf("message %s: %v", key, err)
+		}
+	}
+	return t, nil
+}
+
+// NewMessages returns the built-in catalog for lang with some of its
+// templates replaced by overrides.
+func NewMessages(lang string, overrides map[string]string) (*Messages, error) {
+	c, ok := catalogs[lang]
+	if !ok {
+		return nil, ErrUnknownLanguage
+	}
+	builtin, err := parseMessages(c.messages)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]string, len(c.messages))
+	for key, text := range c.messages {
+		merged[key] = text
+	}
+	for key, text := range overrides {
+		if _, ok := c.messages[key]; !ok {
+			return nil, fmt.Errorf("%v: %s", ErrUnknownMessage, key)
+		}
+		merged[key] = text
+	}
+	templates, err := parseMessages(merged)
+	if err != nil {
+		return nil, err
+	}
+	return &Messages{units: c.units, templates: templates, builtin: builtin}, nil
+}
+
+func MustMessages(lang string, overrides map[string]string) *Messages {
+	m, err := NewMessages(lang, overrides)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Text renders the message key. A template that fails is logged and the
+// built-in one is used instead.
+func (m *Messages) Text(key string, data interface{}) string {
+	var b bytes.Buffer
+	err := m.templates.ExecuteTemplate(&b, key, data)
+	if err == nil {
+		return b.String()
+	}
+	log.Println("message", key, "failed:", err)
+	b.Reset()
+	if err := m.builtin.ExecuteTemplate(&b, key, data); err != nil {
+		return key
+	}
+	return b.String()
+}
+
+func (m *Messages) Duration(d time.Duration) Duration {
+	return Duration{Duration: d, units: m.units}
+}
+
+// Data returns the template variables for event.
+func (m *Messages) Data(event Event) MessageData {
+	data := MessageData{
+		Type:     event.Type,
+		Time:     event.Time,
+		Channel:  event.Channel,
+		File:     event.File,
+		Duration: m.Duration(event.Duration),
+		Size:     Size(event.Size),
+		Error:    event.Error,
+	}
+	if event.Metadata != nil {
+		data.Title = event.Metadata.Title
+		data.Game = event.Metadata.Game
+		data.Viewers = event.Metadata.Viewers
+		data.Gaps = len(event.Metadata.Gaps)
+	}
+	return data
+}
+
+// Event renders the message for the event type.
+func (m *Messages) Event(event Event) string {
+	return strings.TrimSpace(m.Text(string(event.Type), m.Data(event)))
+}
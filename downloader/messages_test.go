@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessages(t *testing.T) {
+	event := Event{
+		Type:     EventFinished,
+		Channel:  "streamer",
+		Duration: 90*time.Minute + 15*time.Second,
+		Size:     3 << 29,
+		Metadata: &Metadata{Title: "title", Game: "game", Viewers: 1200},
+	}
+	Convey("Messages", t, func() {
+		Convey("Catalogs", func() {
+			for key := range catalogs["ru"].messages {
+				_, ok := catalogs["en"].messages[key]
+				So(ok, ShouldBeTrue)
+			}
+			So(len(catalogs["en"].messages), ShouldEqual, len(catalogs["ru"].messages))
+			So(MustMessages("ru", nil).Event(event), ShouldEqual, "Запись для канала streamer завершена; Продолжительность: 1 ч 30 мин")
+			So(MustMessages("en", nil).Event(event), ShouldEqual, "Finished recording streamer; Duration: 1h 30m")
+		})
+		Convey("Overrides", func() {
+			m, err := NewMessages("en", map[string]string{
+				string(EventFinished): "{{.Channel}} ({{.Game}}, {{.Viewers}} viewers): {{.Title}}, {{.Duration}}, {{.Size}}",
+			})
+			So(err, ShouldBeNil)
+			So(m.Event(event), ShouldEqual, "streamer (game, 1200 viewers): title, 1h 30m, 1.5 GiB")
+			So(m.Event(Event{Type: EventStarted, Channel: "streamer"}), ShouldEqual, "Started recording streamer")
+
+			_, err = NewMessages("de", nil)
+			So(err, ShouldEqual, ErrUnknownLanguage)
+			_, err = NewMessages("en", map[string]string{"recording.stopped": "x"})
+			So(err, ShouldNotBeNil)
+			_, err = NewMessages("en", map[string]string{string(EventStarted): "{{.Channel"})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Fallback", func() {
+			m, err := NewMessages("en", map[string]string{string(EventStarted): "{{.Missing}}"})
+			So(err, ShouldBeNil)
+			So(m.Event(Event{Type: EventStarted, Channel: "streamer"}), ShouldEqual, "Started recording streamer")
+		})
+		Convey("Errors", func() {
+			n := &recordedNotifier{}
+			d := &Downloader{channel: "streamer", notifier: n}
+			d.notify("chunk write error", ErrLedger)
+			So(n.messages, ShouldResemble, []string{"Ошибка на канале streamer: chunk write error: Ledger write failed"})
+		})
+		Convey("Duration", func() {
+			en, ru := MustMessages("en", nil), MustMessages("ru", nil)
+			So(en.Duration(0).String(), ShouldEqual, "0s")
+			So(en.Duration(45*time.Second).String(), ShouldEqual, "45s")
+			So(en.Duration(61*time.Minute+30*time.Second).String(), ShouldEqual, "1h 1m")
+			So(en.Duration(2*time.Hour+10*time.Second).String(), ShouldEqual, "2h")
+			So(en.Duration(26*time.Hour).String(), ShouldEqual, "1d 2h")
+			So(ru.Duration(5*time.Minute+3*time.Second).String(), ShouldEqual, "5 мин 3 с")
+			So(Duration{Duration: time.Minute}.String(), ShouldEqual, "1m")
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/cydev/twitch/api"
+)
+
+// Notifier delivers human readable messages about recordings.
+type Notifier interface {
+	Notify(message string) error
+}
+
+// EventNotifier is implemented by notifiers that take structured events
+// instead of messages.
+type EventNotifier interface {
+	NotifyEvent(event Event) error
+}
+
+type EventType string
+
+const (
+	EventOnline   EventType = "stream.online"
+	EventStarted  EventType = "recording.started"
+	EventProgress EventType = "recording.progress"
+	EventFinished EventType = "recording.finished"
+	EventError    EventType = "error"
+	EventMessage  EventType = "message"
+)
+
+// Event describes something that happened to a channel. Message is the
+// text sent to plain notifiers; events without one are not sent to them.
+// Fatal errors need someone to step in before recording can go on.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Channel  string
+	File     string
+	Duration time.Duration
+	Size     int64
+	Metadata *Metadata
+	Error    string
+	Fatal    bool
+	Message  string
+}
+
+func fatal(err error) bool {
+	return errors.Is(err, ErrLedger) ||
+		errors.Is(err, api.ErrUnauthorized) ||
+		errors.Is(err, syscall.ENOSPC)
+}
+
+func deliver(n Notifier, event Event) error {
+	if en, ok := n.(EventNotifier); ok {
+		return en.NotifyEvent(event)
+	}
+	if len(event.Message) == 0 {
+		return nil
+	}
+	return n.Notify(event.Message)
+}
+
+// LogNotifier writes messages to the standard logger.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(message string) error {
+	log.Println("notification:", message)
+	return nil
+}
+
+// NopNotifier discards messages.
+type NopNotifier struct{}
+
+func (NopNotifier) Notify(string) error {
+	return nil
+}
+
+type multiNotifier []Notifier
+
+// MultiNotifier sends every message and event to all notifiers. It returns
+// the first error, but still tries the rest.
+func MultiNotifier(notifiers ...Notifier) Notifier {
+	return multiNotifier(notifiers)
+}
+
+func (m multiNotifier) Notify(message string) (err error) {
+	for _, n := range m {
+		if nErr := n.Notify(message); nErr != nil && err == nil {
+			err = nErr
+		}
+	}
+	return err
+}
+
+func (m multiNotifier) NotifyEvent(event Event) (err error) {
+	for _, n := range m {
+		if nErr := deliver(n, event); nErr != nil && err == nil {
+			err = nErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package downloader
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type failingNotifier struct{ err error }
+
+func (n failingNotifier) Notify(string) error {
+	return n.err
+}
+
+func TestNotifier(t *testing.T) {
+	Convey("MultiNotifier", t, func() {
+		first, second := &recordedNotifier{}, &recordedNotifier{}
+		errFirst, errSecond := errors.New("first"), errors.New("second")
+		n := MultiNotifier(first, failingNotifier{errFirst}, second, failingNotifier{errSecond}, NopNotifier{})
+		So(n.Notify("hello"), ShouldEqual, errFirst)
+		So(first.messages, ShouldResemble, []string{"hello"})
+		So(second.messages, ShouldResemble, []string{"hello"})
+		So(MultiNotifier().Notify("hello"), ShouldBeNil)
+	})
+}
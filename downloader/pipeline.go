@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+type segment struct {
+	seq           uint64
+	url           string
+	duration      time.Duration
+	discontinuity bool
+}
+
+type fetched struct {
+	segment
+	data []byte
+	err  error
+}
+
+type pipeline struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	results     map[int]fetched
+	buffered    int64
+	maxBuffered int64
+	next        int
+}
+
+func (p *pipeline) work(jobs <-chan int, segments []segment, fetch func(string) ([]byte, error)) {
+	for i := range jobs {
+		p.mu.Lock()
+		for p.buffered >= p.maxBuffered && i != p.next {
+			p.cond.Wait()
+		}
+		p.mu.Unlock()
+
+		data, err := fetch(segments[i].url)
+
+		p.mu.Lock()
+		p.results[i] = fetched{segment: segments[i], data: data, err: err}
+		p.buffered += int64(len(data))
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+func (p *pipeline) take() fetched {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if r, ok := p.results[p.next]; ok {
+			delete(p.results, p.next)
+			p.buffered -= int64(len(r.data))
+			p.next++
+			p.cond.Broadcast()
+			return r
+		}
+		p.cond.Wait()
+	}
+}
+
+// fetchOrdered downloads segments with up to workers concurrent requests
+// and passes them to write strictly in the given order. Segments that arrive
+// ahead of the writer are buffered up to about maxBuffered bytes; the
+// segment the writer waits for is always allowed to proceed.
+func fetchOrdered(segments []segment, workers int, maxBuffered int64, fetch func(string) ([]byte, error), write func(fetched)) {
+	if len(segments) == 0 {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+	p := &pipeline{results: make(map[int]fetched), maxBuffered: maxBuffered}
+	p.cond = sync.NewCond(&p.mu)
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		go p.work(jobs, segments, fetch)
+	}
+	go func() {
+		for i := range segments {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	for range segments {
+		write(p.take())
+	}
+}
@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testSegments(n int) (segments []segment) {
+	for i := 0; i < n; i++ {
+		segments = append(segments, segment{seq: uint64(100 + i), url: fmt.Sprint(i)})
+	}
+	return segments
+}
+
+func TestPipeline(t *testing.T) {
+	Convey("Pipeline", t, func() {
+		Convey("Ordered", func() {
+			var (
+				mu       sync.Mutex
+				inFlight int
+				peak     int
+				written  []uint64
+			)
+			fetch := func(u string) ([]byte, error) {
+				mu.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				if u == "3" {
+					return nil, errors.New("failed")
+				}
+				return make([]byte, 10), nil
+			}
+			fetchOrdered(testSegments(20), 4, 1<<20, fetch, func(f fetched) {
+				if f.err == nil {
+					written = append(written, f.seq)
+				}
+			})
+			So(len(written), ShouldEqual, 19)
+			for i := 1; i < len(written); i++ {
+				So(written[i], ShouldBeGreaterThan, written[i-1])
+			}
+			So(peak, ShouldBeLessThanOrEqualTo, 4)
+		})
+		Convey("Memory cap", func() {
+			var (
+				mu      sync.Mutex
+				started int
+				written int
+				ahead   int
+			)
+			fetch := func(u string) ([]byte, error) {
+				mu.Lock()
+				started++
+				if d := started - written; d > ahead {
+					ahead = d
+				}
+				mu.Unlock()
+				return make([]byte, 100), nil
+			}
+			fetchOrdered(testSegments(50), 8, 250, fetch, func(f fetched) {
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				written++
+				mu.Unlock()
+			})
+			So(written, ShouldEqual, 50)
+			So(ahead, ShouldBeLessThanOrEqualTo, 3+8)
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package downloader
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	sourceVideo = "chunked"
+	audioVideo  = "audio_only"
+)
+
+var (
+	ErrBadQuality = errors.New("Bad quality")
+
+	qualityRegexp = regexp.MustCompile(`^(\d+)p(\d+)?$`)
+	labelRegexp   = regexp.MustCompile(`(\d+)p(\d+)?`)
+)
+
+type qualityKind int
+
+const (
+	qualitySource qualityKind = iota
+	qualityAudio
+	qualityBest
+	qualityWorst
+	qualityExact
+)
+
+type qualityRule struct {
+	kind   qualityKind
+	label  string
+	height int
+	fps    int
+}
+
+// Quality is an ordered list of rules, the first rule that matches
+// any variant of the master playlist wins.
+type Quality []qualityRule
+
+type variantInfo struct {
+	variant *m3u8.Variant
+	labels  []string
+	height  int
+	fps     int
+	audio   bool
+	source  bool
+}
+
+func parseQualityRule(s string) (rule qualityRule, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	rule.label = s
+	switch s {
+	case "source":
+		rule.kind = qualitySource
+		return rule, nil
+	case "audio", audioVideo:
+		rule.kind = qualityAudio
+		return rule, nil
+	case "best":
+		rule.kind = qualityBest
+		return rule, nil
+	case "worst":
+		rule.kind = qualityWorst
+		return rule, nil
+	}
+	limit := s
+	if strings.HasPrefix(s, "best:") {
+		rule.kind = qualityBest
+		limit = strings.TrimPrefix(s, "best:")
+	} else {
+		rule.kind = qualityExact
+	}
+	m := qualityRegexp.FindStringSubmatch(limit)
+	if m == nil {
+		return rule, ErrBadQuality
+	}
+	rule.height, _ = strconv.Atoi(m[1])
+	if len(m[2]) > 0 {
+		rule.fps, _ = strconv.Atoi(m[2])
+	}
+	return rule, nil
+}
+
+// ParseQuality parses comma separated quality rules, e.g.
+// "source", "720p60", "best:1080p", "audio_only" or "source,720p60,best".
+func ParseQuality(s string) (q Quality, err error) {
+	for _, field := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(field)) == 0 {
+			continue
+		}
+		rule, err := parseQualityRule(field)
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, rule)
+	}
+	if len(q) == 0 {
+		return nil, ErrBadQuality
+	}
+	return q, nil
+}
+
+func newVariantInfo(v *m3u8.Variant) (info variantInfo) {
+	info.variant = v
+	video := strings.ToLower(v.Video)
+	name := strings.ToLower(v.Name)
+	info.labels = []string{video, name}
+	for _, alt := range v.Alternatives {
+		if alt != nil && alt.Type == "VIDEO" && strings.EqualFold(alt.GroupId, v.Video) {
+			name = strings.ToLower(alt.Name)
+			info.labels = append(info.labels, name)
+		}
+	}
+	info.source = video == sourceVideo || strings.Contains(name, "source")
+	info.audio = video == audioVideo || strings.Contains(name, "audio")
+	if parts := strings.Split(v.Resolution, "x"); len(parts) == 2 {
+		info.height, _ = strconv.Atoi(parts[1])
+	}
+	for _, label := range info.labels {
+		m := labelRegexp.FindStringSubmatch(label)
+		if m == nil {
+			continue
+		}
+		if info.height == 0 {
+			info.height, _ = strconv.Atoi(m[1])
+		}
+		if len(m[2]) > 0 {
+			info.fps, _ = strconv.Atoi(m[2])
+		}
+		break
+	}
+	if info.fps == 0 && v.FrameRate > 0 {
+		info.fps = int(v.FrameRate + 0.5)
+	}
+	if info.fps == 0 && !info.audio {
+		info.fps = 30
+	}
+	if info.height == 0 && len(v.Resolution) == 0 && !info.source {
+		info.audio = true
+	}
+	return info
+}
+
+func (info variantInfo) better(other variantInfo) bool {
+	if info.height != other.height {
+		return info.height > other.height
+	}
+	if info.fps != other.fps {
+		return info.fps > other.fps
+	}
+	if info.source != other.source {
+		return info.source
+	}
+	return info.variant.Bandwidth > other.variant.Bandwidth
+}
+
+func (rule qualityRule) matches(info variantInfo) bool {
+	switch rule.kind {
+	case qualitySource:
+		return info.source
+	case qualityAudio:
+		return info.audio
+	case qualityBest, qualityWorst:
+		if info.audio {
+			return false
+		}
+		if rule.height > 0 && info.height > rule.height {
+			return false
+		}
+		if rule.fps > 0 && info.fps > rule.fps {
+			return false
+		}
+		return true
+	case qualityExact:
+		for _, label := range info.labels {
+			if label == rule.label {
+				return true
+			}
+		}
+		if info.audio || info.height != rule.height {
+			return false
+		}
+		if rule.fps > 0 {
+			return info.fps == rule.fps
+		}
+		return info.fps <= 30
+	}
+	return false
+}
+
+func (rule qualityRule) pick(variants []variantInfo) (found variantInfo, ok bool) {
+	for _, info := range variants {
+		if !rule.matches(info) {
+			continue
+		}
+		if !ok {
+			found, ok = info, true
+			continue
+		}
+		switch rule.kind {
+		case qualityWorst:
+			if found.better(info) {
+				found = info
+			}
+		case qualityBest:
+			if info.better(found) {
+				found = info
+			}
+		}
+	}
+	return found, ok
+}
+
+func (q Quality) Select(variants []*m3u8.Variant) (*m3u8.Variant, error) {
+	infos := make([]variantInfo, 0, len(variants))
+	for _, v := range variants {
+		if v == nil || v.Iframe {
+			continue
+		}
+		infos = append(infos, newVariantInfo(v))
+	}
+	for _, rule := range q {
+		if info, ok := rule.pick(infos); ok {
+			return info.variant, nil
+		}
+	}
+	return nil, ErrTargetVideoNotFound
+}
+
+func (q Quality) String() string {
+	labels := make([]string, len(q))
+	for i, rule := range q {
+		labels[i] = rule.label
+	}
+	return strings.Join(labels, ",")
+}
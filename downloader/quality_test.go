@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grafov/m3u8"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const masterPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="chunked",NAME="1080p60 (source)",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=6000000,RESOLUTION=1920x1080,VIDEO="chunked"
+http://example.com/chunked.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p60",NAME="720p60",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=3000000,RESOLUTION=1280x720,VIDEO="720p60"
+http://example.com/720p60.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p30",NAME="720p",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=2000000,RESOLUTION=1280x720,VIDEO="720p30"
+http://example.com/720p30.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="480p30",NAME="480p",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=1000000,RESOLUTION=852x480,VIDEO="480p30"
+http://example.com/480p30.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="audio_only",NAME="audio_only",AUTOSELECT=NO,DEFAULT=NO
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=160000,CODECS="mp4a.40.2",VIDEO="audio_only"
+http://example.com/audio_only.m3u8
+`
+
+func decodeVariants(s string) []*m3u8.Variant {
+	p, _, err := m3u8.DecodeFrom(bytes.NewBufferString(s), true)
+	if err != nil {
+		panic(err)
+	}
+	return p.(*m3u8.MasterPlaylist).Variants
+}
+
+func selectURI(policy string, variants []*m3u8.Variant) string {
+	q, err := ParseQuality(policy)
+	So(err, ShouldBeNil)
+	v, err := q.Select(variants)
+	if err != nil {
+		return ""
+	}
+	return v.URI
+}
+
+func TestQuality(t *testing.T) {
+	Convey("Quality", t, func() {
+		variants := decodeVariants(masterPlaylist)
+		So(len(variants), ShouldEqual, 5)
+		Convey("Source", func() {
+			So(selectURI("source", variants), ShouldEqual, "http://example.com/chunked.m3u8")
+		})
+		Convey("Exact", func() {
+			So(selectURI("720p60", variants), ShouldEqual, "http://example.com/720p60.m3u8")
+			So(selectURI("720p", variants), ShouldEqual, "http://example.com/720p30.m3u8")
+			So(selectURI("360p", variants), ShouldBeBlank)
+		})
+		Convey("Best", func() {
+			So(selectURI("best", variants), ShouldEqual, "http://example.com/chunked.m3u8")
+			So(selectURI("best:720p", variants), ShouldEqual, "http://example.com/720p60.m3u8")
+			So(selectURI("best:720p30", variants), ShouldEqual, "http://example.com/720p30.m3u8")
+			So(selectURI("best:1080p30", variants), ShouldEqual, "http://example.com/720p30.m3u8")
+			So(selectURI("worst", variants), ShouldEqual, "http://example.com/480p30.m3u8")
+		})
+		Convey("Audio", func() {
+			So(selectURI("audio_only", variants), ShouldEqual, "http://example.com/audio_only.m3u8")
+		})
+		Convey("Fallback", func() {
+			So(selectURI("360p,720p60,best", variants), ShouldEqual, "http://example.com/720p60.m3u8")
+			withoutSource := variants[1:]
+			So(selectURI("source,best", withoutSource), ShouldEqual, "http://example.com/720p60.m3u8")
+		})
+		Convey("Bad", func() {
+			_, err := ParseQuality("ultra")
+			So(err, ShouldEqual, ErrBadQuality)
+			_, err = ParseQuality("")
+			So(err, ShouldEqual, ErrBadQuality)
+		})
+	})
+}
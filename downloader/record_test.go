@@ -0,0 +1,319 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cydev/twitch/api"
+	"github.com/cydev/twitch/mp4"
+	"github.com/cydev/twitch/twitchtest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordedNotifier struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (n *recordedNotifier) Notify(message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func newTestDownloader(srv *twitchtest.Server, name, dir string) *Downloader {
+	twitch, err := api.NewTwitchAPI(srv.Client(), srv.URL)
+	So(err, ShouldBeNil)
+	usher, err := api.NewUsherAPI(srv.URL)
+	So(err, ShouldBeNil)
+	q, err := ParseQuality("source,best")
+	So(err, ShouldBeNil)
+	return &Downloader{
+		channel:          name,
+		dir:              dir,
+		httpClient:       srv.Client(),
+		twitch:           twitch,
+		usher:            usher,
+		channelAPI:       twitch,
+		notifier:         &recordedNotifier{},
+		quality:          q,
+		format:           FormatTS,
+		workers:          2,
+		maxBuffered:      1 << 20,
+		checkInterval:    10 * time.Millisecond,
+		downloadInterval: 10 * time.Millisecond,
+		minRetryDeadline: 50 * time.Millisecond,
+	}
+}
+
+func waitFor(condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			panic("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// settle waits until the downloader has polled the playlist twice, so
+// everything listed before the call is written.
+func settle(c *twitchtest.Channel) {
+	n := c.PlaylistRequests()
+	waitFor(func() bool { return c.PlaylistRequests() >= n+2 })
+}
+
+func TestRecord(t *testing.T) {
+	Convey("Record", t, func() {
+		dir, err := ioutil.TempDir("", "record")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		srv := twitchtest.NewServer()
+		defer srv.Close()
+		srv.SegmentDuration = 100 * time.Millisecond
+		ticks := uint64(srv.SegmentDuration.Seconds() * 90000)
+		c := srv.Channel("streamer")
+		d := newTestDownloader(srv, "streamer", dir)
+
+		Convey("Offline", func() {
+			_, err := d.getStream(context.Background())
+			So(err, ShouldEqual, ErrStreamOffline)
+			_, err = newTestDownloader(srv, "missing", dir).getStream(context.Background())
+			So(errors.Is(err, api.ErrNotFound), ShouldBeTrue)
+		})
+		Convey("Concurrency slots", func() {
+			d.httpClient = newLimitedClient(srv.Client(), 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 10; i++ {
+					d.getStream(context.Background())
+				}
+				c.GoLive(41, "title", "game")
+				c.Append(1)
+				for i := 0; i < 10; i++ {
+					d.getStream(context.Background())
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("polling blocked on a leaked concurrency slot")
+			}
+
+			req, err := http.NewRequest("GET", srv.URL, nil)
+			So(err, ShouldBeNil)
+			res, err := d.httpClient.Do(req)
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = d.httpClient.Do(req.WithContext(ctx))
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+		Convey("Broadcast", func() {
+			c.GoLive(42, "title", "game")
+			c.Append(3)
+			stream, err := d.getStream(context.Background())
+			So(err, ShouldBeNil)
+			So(stream.Name, ShouldEqual, "chunked")
+
+			done := make(chan error, 1)
+			go func() { done <- d.Download(stream) }()
+			settle(c)
+			c.Append(2)
+			settle(c)
+			c.Skip(3)
+			c.Append(2)
+			settle(c)
+			c.Drop(1)
+			c.Append(1)
+			settle(c)
+			c.End()
+			err = <-done
+			So(errors.Is(err, api.ErrNotFound), ShouldBeTrue)
+
+			var expected []byte
+			for _, seq := range []uint64{0, 1, 2, 3, 4, 8, 9, 11} {
+				expected = append(expected, twitchtest.Segment(seq*ticks, ticks, 1920, 1080)...)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, d.fileName))
+			So(err, ShouldBeNil)
+			So(bytes.Equal(data, expected), ShouldBeTrue)
+			So(c.Fetched(10), ShouldBeGreaterThan, 0)
+
+			ledger, err := OpenLedger(filepath.Join(dir, GetLedgerFileName(d.fileName)))
+			So(err, ShouldBeNil)
+			defer ledger.Close()
+			So(ledger.Len(), ShouldEqual, 8)
+
+			So(d.metadata.Title, ShouldEqual, "title")
+			So(d.metadata.Game, ShouldEqual, "game")
+			So(d.metadata.StreamID, ShouldEqual, 42)
+			So(len(d.metadata.Gaps), ShouldEqual, 2)
+			So(d.metadata.Gaps[0].From, ShouldEqual, 5)
+			So(d.metadata.Gaps[0].To, ShouldEqual, 7)
+			So(d.metadata.Gaps[1].From, ShouldEqual, 10)
+			So(d.metadata.Gaps[1].To, ShouldEqual, 10)
+		})
+		Convey("Late segment", func() {
+			c.GoLive(46, "title", "game")
+			c.Append(2)
+			stream, err := d.getStream(context.Background())
+			So(err, ShouldBeNil)
+			done := make(chan error, 1)
+			go func() { done <- d.Download(stream) }()
+			settle(c)
+			c.Drop(1)
+			c.Append(1)
+			settle(c)
+			c.Restore(2)
+			settle(c)
+			c.End()
+			<-done
+
+			var expected []byte
+			for _, seq := range []uint64{0, 1, 3} {
+				expected = append(expected, twitchtest.Segment(seq*ticks, ticks, 1920, 1080)...)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, d.fileName))
+			So(err, ShouldBeNil)
+			So(bytes.Equal(data, expected), ShouldBeTrue)
+			So(len(d.metadata.Gaps), ShouldEqual, 1)
+			So(d.metadata.Gaps[0].From, ShouldEqual, 2)
+			So(d.metadata.Gaps[0].Discontinuity, ShouldBeFalse)
+		})
+		Convey("Variant rotation", func() {
+			c.GoLive(43, "title", "game")
+			c.Append(2)
+			stream, err := d.getStream(context.Background())
+			So(err, ShouldBeNil)
+			So(stream.Name, ShouldEqual, "chunked")
+
+			done := make(chan error, 1)
+			go func() { done <- d.Download(stream) }()
+			settle(c)
+			c.SetVariants(twitchtest.DefaultVariants[1:]...)
+			err = <-done
+			So(errors.Is(err, api.ErrNotFound), ShouldBeTrue)
+
+			stream, err = d.getStream(context.Background())
+			So(err, ShouldBeNil)
+			So(stream.Name, ShouldEqual, "720p60")
+		})
+		Convey("Cancel", func() {
+			c.GoLive(44, "title", "game")
+			c.Append(2)
+			stream, err := d.getStream(context.Background())
+			So(err, ShouldBeNil)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- d.DownloadContext(ctx, stream) }()
+			settle(c)
+			cancel()
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("download did not stop")
+			}
+			So(err, ShouldEqual, context.Canceled)
+
+			f, err := os.Open(filepath.Join(dir, GetMetadataFileName(d.fileName)))
+			So(err, ShouldBeNil)
+			defer f.Close()
+			metadata, err := ReadMetadata(f)
+			So(err, ShouldBeNil)
+			So(metadata.StreamID, ShouldEqual, 44)
+			So(metadata.End.IsZero(), ShouldBeFalse)
+			So(metadata.Duration, ShouldBeGreaterThan, 0)
+			n := d.notifier.(*recordedNotifier)
+			So(n.messages[len(n.messages)-1], ShouldContainSubstring, "завершена")
+			So(c.Fetched(1), ShouldEqual, 1)
+			data, err := ioutil.ReadFile(filepath.Join(dir, d.fileName))
+			So(err, ShouldBeNil)
+			So(len(data), ShouldEqual, 2*len(twitchtest.Segment(0, ticks, 1920, 1080)))
+		})
+		Convey("MP4 resume", func() {
+			c.GoLive(46, "title", "game")
+			c.Append(2)
+			record := func() *Downloader {
+				d := newTestDownloader(srv, "streamer", dir)
+				d.format = FormatMP4
+				stream, err := d.getStream(context.Background())
+				So(err, ShouldBeNil)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan error, 1)
+				go func() { done <- d.DownloadContext(ctx, stream) }()
+				settle(c)
+				cancel()
+				So(<-done, ShouldEqual, context.Canceled)
+				return d
+			}
+			tracks := func(name string) []uint32 {
+				f, err := os.Open(filepath.Join(dir, name))
+				So(err, ShouldBeNil)
+				defer f.Close()
+				ids, err := mp4.InitTracks(f)
+				So(err, ShouldBeNil)
+				return ids
+			}
+
+			first := record()
+			So(first.fileName, ShouldEqual, "streamer-46.mp4")
+			So(tracks(first.fileName), ShouldResemble, []uint32{1, 2})
+			c.Append(2)
+			second := record()
+			So(second.fileName, ShouldEqual, first.fileName)
+			data, err := ioutil.ReadFile(filepath.Join(dir, second.fileName))
+			So(err, ShouldBeNil)
+			So(bytes.Count(data, []byte("moov")), ShouldEqual, 1)
+			So(bytes.Count(data, []byte("moof")), ShouldEqual, 4)
+
+			So(os.Remove(filepath.Join(dir, GetLedgerFileName(first.fileName))), ShouldBeNil)
+			c.Append(1)
+			third := record()
+			So(third.fileName, ShouldEqual, "streamer-46-1.mp4")
+			kept, err := ioutil.ReadFile(filepath.Join(dir, first.fileName))
+			So(err, ShouldBeNil)
+			So(kept, ShouldResemble, data)
+			So(tracks(third.fileName), ShouldResemble, []uint32{1, 2})
+		})
+		Convey("Start", func() {
+			c.GoLive(45, "title", "game")
+			c.Append(3)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				d.StartContext(ctx)
+				close(done)
+			}()
+			waitFor(func() bool { return d.Status().Segments == 3 })
+			status := d.Status()
+			So(status.State, ShouldEqual, StateRecording)
+			So(status.Channel, ShouldEqual, "streamer")
+			So(status.File, ShouldNotBeEmpty)
+			So(status.Bytes, ShouldEqual, 3*len(twitchtest.Segment(0, ticks, 1920, 1080)))
+			So(status.Started.IsZero(), ShouldBeFalse)
+
+			c.End()
+			waitFor(func() bool { return d.Status().State == StateWaiting })
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("downloader did not stop")
+			}
+			So(d.Status().State, ShouldEqual, StateIdle)
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	retryBaseDelay      = 250 * time.Millisecond
+	retryMaxDelay       = 4 * time.Second
+	retryDeadlineFactor = 3
+	minRetryDeadline    = 5 * time.Second
+)
+
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("Unexpected status %d for %s", e.StatusCode, e.URL)
+}
+
+// backoff returns the delay before the given retry attempt: exponential
+// growth capped at retryMaxDelay, with the upper half randomized.
+func backoff(attempt int) time.Duration {
+	return backoffUpTo(attempt, retryMaxDelay)
+}
+
+func backoffUpTo(attempt int, max time.Duration) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// segmentDeadline is how long a live segment is worth retrying: a segment
+// stays in the playlist for a few target durations.
+func (d *Downloader) segmentDeadline(targetDuration time.Duration) time.Duration {
+	deadline := retryDeadlineFactor * targetDuration
+	if deadline < d.minRetryDeadline {
+		deadline = d.minRetryDeadline
+	}
+	return deadline
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Downloader) fetchSegment(ctx context.Context, segmentURL string, deadline time.Duration) (data []byte, err error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if data, err = d.DownloadChunkContext(ctx, segmentURL); err == nil {
+			return data, nil
+		}
+		delay := backoff(attempt)
+		if time.Since(start)+delay > deadline || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Println("retrying", segmentURL, "in", delay, "after", err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *Downloader) segmentFetcher(ctx context.Context, deadline time.Duration) func(string) ([]byte, error) {
+	return func(segmentURL string) ([]byte, error) {
+		return d.fetchSegment(ctx, segmentURL, deadline)
+	}
+}
@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type statusClient struct {
+	mu       sync.Mutex
+	statuses []int
+	calls    int
+}
+
+func (c *statusClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := http.StatusOK
+	if c.calls < len(c.statuses) {
+		status = c.statuses[c.calls]
+	}
+	c.calls++
+	res := &http.Response{StatusCode: status}
+	res.Body = ioutil.NopCloser(bytes.NewBufferString("segment"))
+	return res, nil
+}
+
+func TestRetry(t *testing.T) {
+	Convey("Retry", t, func() {
+		Convey("Backoff", func() {
+			for attempt := 0; attempt < 10; attempt++ {
+				delay := backoff(attempt)
+				So(delay, ShouldBeGreaterThanOrEqualTo, retryBaseDelay/2)
+				So(delay, ShouldBeLessThanOrEqualTo, retryMaxDelay)
+			}
+			So(backoffUpTo(20, webhookMaxDelay), ShouldBeGreaterThanOrEqualTo, webhookMaxDelay/2)
+			So(backoffUpTo(20, webhookMaxDelay), ShouldBeLessThanOrEqualTo, webhookMaxDelay)
+			d := &Downloader{minRetryDeadline: minRetryDeadline}
+			So(d.segmentDeadline(time.Second), ShouldEqual, minRetryDeadline)
+			So(d.segmentDeadline(4*time.Second), ShouldEqual, 12*time.Second)
+		})
+		Convey("Bad status is retried", func() {
+			client := &statusClient{statuses: []int{http.StatusBadGateway}}
+			d := &Downloader{httpClient: client}
+			data, err := d.fetchSegment(context.Background(), "http://example.com/1.ts", time.Second)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "segment")
+			So(client.calls, ShouldEqual, 2)
+		})
+		Convey("Deadline", func() {
+			client := &statusClient{statuses: []int{404, 404, 404, 404, 404, 404}}
+			d := &Downloader{httpClient: client}
+			_, err := d.fetchSegment(context.Background(), "http://example.com/1.ts", 100*time.Millisecond)
+			So(err, ShouldResemble, StatusError{URL: "http://example.com/1.ts", StatusCode: 404})
+			So(client.calls, ShouldBeLessThan, 3)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// slackEscape escapes the characters mrkdwn treats as control sequences.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks,omitempty"`
+}
+
+// Slack posts events as Block Kit messages to a Slack incoming webhook.
+type Slack struct {
+	hook *chatWebhook
+}
+
+func NewSlack(client HTTPClient, url string) (*Slack, error) {
+	hook, err := newChatWebhook(client, url)
+	if err != nil {
+		return nil, err
+	}
+	return &Slack{hook: hook}, nil
+}
+
+// Flush waits until the queued messages are delivered or ctx is done.
+func (s *Slack) Flush(ctx context.Context) error {
+	return s.hook.flush(ctx)
+}
+
+// Close drops the messages still queued.
+func (s *Slack) Close() error {
+	s.hook.stop()
+	return nil
+}
+
+func (s *Slack) Notify(message string) error {
+	return s.hook.post(slackMessage{Text: message})
+}
+
+func (s *Slack) NotifyEvent(event Event) error {
+	if event.Type == EventMessage {
+		return s.Notify(event.Message)
+	}
+	text := headline(event)
+	msg := slackMessage{
+		Text: text,
+		Blocks: []slackBlock{{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("<%s|%s>", channelURL(event.Channel), slackEscape.Replace(text))},
+		}},
+	}
+	var fields []slackText
+	for _, f := range chatFields(event) {
+		fields = append(fields, slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", f.Name, slackEscape.Replace(f.Value))})
+	}
+	if len(fields) > 0 {
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "section", Fields: fields})
+	}
+	return s.hook.post(msg)
+}
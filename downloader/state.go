@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+type State int
+
+const (
+	StateIdle State = iota
+	StateWaiting
+	StateRecording
+	StateFinalizing
+)
+
+var ErrBadTransition = errors.New("Bad state transition")
+
+var stateNames = map[State]string{
+	StateIdle:       "idle",
+	StateWaiting:    "waiting",
+	StateRecording:  "recording",
+	StateFinalizing: "finalizing",
+}
+
+var transitions = map[State][]State{
+	StateIdle:       {StateWaiting, StateRecording},
+	StateWaiting:    {StateRecording, StateIdle},
+	StateRecording:  {StateFinalizing},
+	StateFinalizing: {StateWaiting, StateIdle},
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status is a consistent snapshot of a downloader. File, Started, Bytes,
+// Size and Segments describe the current or last recording; Bytes counts
+// what was written since it started or resumed, Size is the file size.
+type Status struct {
+	Channel   string
+	State     State
+	File      string
+	Started   time.Time
+	Bytes     int64
+	Size      int64
+	Segments  int
+	Errors    int
+	Gaps      int
+	LastError string
+}
+
+func (d *Downloader) moveTo(to State) error {
+	for _, allowed := range transitions[d.state] {
+		if allowed == to {
+			d.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", ErrBadTransition, d.state, to)
+}
+
+func (d *Downloader) transition(to State) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.moveTo(to)
+}
+
+func (d *Downloader) setState(to State) {
+	if err := d.transition(to); err != nil {
+		log.Println(d.channel, err)
+	}
+}
+
+// startRecording moves to StateRecording and resets the recording counters.
+// It returns the state to go back to when the recording is finished.
+func (d *Downloader) startRecording() (previous State, started time.Time, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous = d.state
+	if err := d.moveTo(StateRecording); err != nil {
+		return previous, started, err
+	}
+	d.started = time.Now()
+	d.written = 0
+	d.segments = 0
+	return previous, d.started, nil
+}
+
+func (d *Downloader) countSegment(written, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written += written
+	d.size = size
+	d.segments++
+}
+
+func (d *Downloader) countError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors++
+	d.lastError = err.Error()
+}
+
+func (d *Downloader) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Status{
+		Channel:   d.channel,
+		State:     d.state,
+		File:      d.fileName,
+		Started:   d.started,
+		Bytes:     d.written,
+		Size:      d.size,
+		Segments:  d.segments,
+		Errors:    d.errors,
+		Gaps:      len(d.metadata.Gaps),
+		LastError: d.lastError,
+	}
+}
@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestState(t *testing.T) {
+	Convey("State", t, func() {
+		d := &Downloader{channel: "test"}
+		So(d.Status().State, ShouldEqual, StateIdle)
+		So(d.transition(StateWaiting), ShouldBeNil)
+
+		previous, started, err := d.startRecording()
+		So(err, ShouldBeNil)
+		So(previous, ShouldEqual, StateWaiting)
+		So(started.IsZero(), ShouldBeFalse)
+		_, _, err = d.startRecording()
+		So(errors.Is(err, ErrBadTransition), ShouldBeTrue)
+
+		d.countSegment(100, 100)
+		d.countSegment(50, 150)
+		d.countError(ErrLedger)
+		status := d.Status()
+		So(status.State, ShouldEqual, StateRecording)
+		So(status.Bytes, ShouldEqual, 150)
+		So(status.Size, ShouldEqual, 150)
+		So(status.Segments, ShouldEqual, 2)
+		So(status.Errors, ShouldEqual, 1)
+		So(status.LastError, ShouldEqual, ErrLedger.Error())
+
+		So(errors.Is(d.transition(StateWaiting), ErrBadTransition), ShouldBeTrue)
+		So(d.transition(StateFinalizing), ShouldBeNil)
+		So(d.transition(previous), ShouldBeNil)
+		So(d.Status().State.String(), ShouldEqual, "waiting")
+	})
+}
@@ -0,0 +1,164 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cydev/twitch/api"
+)
+
+type limitedClient struct {
+	client HTTPClient
+	slots  chan struct{}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Do waits for a free slot, giving up when the request context is done.
+func (c limitedClient) Do(req *http.Request) (*http.Response, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-c.slots }
+	res, err := c.client.Do(req)
+	if err != nil {
+		release()
+		return res, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+func newLimitedClient(client HTTPClient, limit int) HTTPClient {
+	if limit <= 0 {
+		return client
+	}
+	return limitedClient{client: client, slots: make(chan struct{}, limit)}
+}
+
+type Supervisor struct {
+	httpClient  HTTPClient
+	notifier    Notifier
+	twitch      api.TwitchAPI
+	channelAPI  api.ChannelAPI
+	watch       *watchList
+	downloaders []*Downloader
+	mu          sync.Mutex
+}
+
+func (s *Supervisor) Add(name string) *Downloader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.downloaders {
+		if d.channel == name {
+			return d
+		}
+	}
+	d := newDownloader(name, s.httpClient, s.notifier, s.twitch, s.channelAPI)
+	if s.watch != nil {
+		d.liveness = s.watch
+	}
+	s.downloaders = append(s.downloaders, d)
+	return d
+}
+
+func (s *Supervisor) channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.downloaders))
+	for _, d := range s.downloaders {
+		names = append(names, d.channel)
+	}
+	return names
+}
+
+// Report describes what every downloader is doing, one line per channel.
+func (s *Supervisor) Report() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := make([]string, 0, len(s.downloaders))
+	for _, d := range s.downloaders {
+		status := d.Status()
+		data := MessageData{
+			Channel:  status.Channel,
+			File:     status.File,
+			Duration: DefaultMessages.Duration(time.Now().Sub(status.Started)),
+			Size:     Size(status.Size),
+			Gaps:     status.Gaps,
+		}
+		if status.State != StateRecording {
+			lines = append(lines, DefaultMessages.Text(MessageStatusIdle, data))
+		} else {
+			lines = append(lines, DefaultMessages.Text(MessageStatusActive, data))
+		}
+	}
+	if len(lines) == 0 {
+		return DefaultMessages.Text(MessageStatusEmpty, nil)
+	}
+	lines = append(lines, DefaultMessages.Text(MessageStatusAPI, api.Limiter.Remaining()))
+	return strings.Join(lines, "\n")
+}
+
+func (s *Supervisor) DownloadVOD(id string) error {
+	return s.DownloadVODContext(context.Background(), id)
+}
+
+func (s *Supervisor) DownloadVODContext(ctx context.Context, id string) error {
+	d := newDownloader("", s.httpClient, s.notifier, s.twitch, s.channelAPI)
+	return d.DownloadVODContext(ctx, id)
+}
+
+func (s *Supervisor) Start() {
+	s.StartContext(context.Background())
+}
+
+// StartContext runs every downloader until ctx is done.
+func (s *Supervisor) StartContext(ctx context.Context) {
+	s.mu.Lock()
+	downloaders := make([]*Downloader, len(s.downloaders))
+	copy(downloaders, s.downloaders)
+	s.mu.Unlock()
+
+	if s.watch != nil {
+		go s.watch.loop(ctx, s.channels)
+	}
+	var wg sync.WaitGroup
+	for _, d := range downloaders {
+		wg.Add(1)
+		go func(d *Downloader) {
+			defer wg.Done()
+			d.StartContext(ctx)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func NewSupervisor(client HTTPClient, notifier Notifier) *Supervisor {
+	s := new(Supervisor)
+	s.httpClient = newLimitedClient(client, concurrency)
+	s.twitch, s.channelAPI = newAPIs(s.httpClient)
+	if helix, ok := s.channelAPI.(api.Helix); ok {
+		s.watch = newWatchList(helix)
+	}
+	s.notifier = notifier
+	if s.notifier == nil {
+		s.notifier = LogNotifier{}
+	}
+	return s
+}
@@ -0,0 +1,193 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cydev/twitch/api"
+	"github.com/grafov/m3u8"
+)
+
+const vodRetryDeadline = time.Minute
+
+var (
+	ErrBadPlaylist   = errors.New("Bad playlist type")
+	ErrVODIncomplete = errors.New("VOD segments failed")
+)
+
+func (d *Downloader) getVODStream(ctx context.Context, id string) (stream Stream, err error) {
+	tok, err := d.twitch.TokenContext(ctx, api.TokenVideo, id)
+	if err != nil {
+		return stream, err
+	}
+	u := d.usher.Video(id, tok.Values())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return stream, err
+	}
+	req = req.WithContext(ctx)
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		return stream, err
+	}
+	defer res.Body.Close()
+	if err := api.CheckResponse(res); err != nil {
+		return stream, err
+	}
+	p, _, err := m3u8.DecodeFrom(res.Body, true)
+	if err != nil {
+		return stream, err
+	}
+	master, ok := p.(*m3u8.MasterPlaylist)
+	if !ok {
+		return stream, ErrBadPlaylist
+	}
+	variant, err := d.quality.Select(master.Variants)
+	if err != nil {
+		return stream, err
+	}
+	log.Println("selected variant", variant.Video, variant.Name, variant.Resolution)
+	stream.Name = variant.Video
+	stream.URL = variant.URI
+	return stream, nil
+}
+
+func (d *Downloader) getVODMetadata(ctx context.Context, id string) (metadata Metadata) {
+	metadata.StreamID, _ = strconv.ParseInt(strings.TrimPrefix(id, "v"), 10, 64)
+	video, err := d.twitch.VideoContext(ctx, id)
+	if err != nil {
+		log.Println("unable to get video metadata:", err)
+		metadata.Date = time.Now()
+		metadata.Channel = "vod"
+		return metadata
+	}
+	metadata.Title = video.Title
+	metadata.Game = video.Game
+	metadata.Date = video.RecordedAt
+	metadata.Author = video.Channel.DisplayName
+	metadata.Channel = video.Channel.Name
+	if metadata.Date.IsZero() {
+		metadata.Date = time.Now()
+	}
+	return metadata
+}
+
+// vodSegments returns the segments of the video missing from the ledger
+// and the length of the whole video.
+func (d *Downloader) vodSegments(ctx context.Context, stream Stream) (segments []segment, length time.Duration, err error) {
+	req, err := http.NewRequest("GET", stream.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if err := api.CheckResponse(res); err != nil {
+		return nil, 0, err
+	}
+	p, _, err := m3u8.DecodeFrom(res.Body, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	media, ok := p.(*m3u8.MediaPlaylist)
+	if !ok {
+		return nil, 0, ErrBadPlaylist
+	}
+	playlistURL, err := url.Parse(stream.URL)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, s := range media.Segments {
+		if s == nil {
+			continue
+		}
+		seq := media.SeqNo + uint64(i)
+		duration := time.Duration(s.Duration * float64(time.Second))
+		length += duration
+		// VOD playlists do not change, so a sequence number in the ledger
+		// is a segment already written, even when an earlier one failed.
+		if d.ledger.Written(seq) {
+			continue
+		}
+		u, err := playlistURL.Parse(s.URI)
+		if err != nil {
+			return nil, 0, err
+		}
+		segments = append(segments, segment{
+			seq:           seq,
+			url:           u.String(),
+			duration:      duration,
+			discontinuity: s.Discontinuity,
+		})
+	}
+	return segments, length, nil
+}
+
+// finishVODMetadata records the length of the video as the duration, so
+// VOD metadata has the End and Duration of live recordings.
+func (d *Downloader) finishVODMetadata(length time.Duration) {
+	d.mu.Lock()
+	end := d.metadata.Date.Add(length)
+	d.metadata.Duration = 0
+	d.mu.Unlock()
+	d.finishMetadata(end, length)
+}
+
+// DownloadVOD saves a past broadcast with the same file and metadata
+// layout as live recordings. Interrupted downloads are resumed.
+func (d *Downloader) DownloadVOD(id string) error {
+	return d.DownloadVODContext(context.Background(), id)
+}
+
+// DownloadVODContext is DownloadVOD that stops when ctx is done, keeping
+// the segments written so far for the next run.
+func (d *Downloader) DownloadVODContext(ctx context.Context, id string) error {
+	stream, err := d.getVODStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	metadata := d.getVODMetadata(ctx, id)
+	d.channel = metadata.Channel
+	if err := d.prepareFile(metadata); err != nil {
+		return err
+	}
+	defer d.closeFile()
+	segments, length, err := d.vodSegments(ctx, stream)
+	if err != nil {
+		return err
+	}
+	defer d.finishVODMetadata(length)
+	log.Println("downloading", len(segments), "segments of video", id)
+
+	failed := 0
+	fetchOrdered(segments, d.workers, d.maxBuffered, d.segmentFetcher(ctx, vodRetryDeadline), func(s fetched) {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.err == nil {
+			s.err = d.writeSegment(s.seq, s.url, s.data, s.discontinuity, s.duration)
+		}
+		if s.err != nil {
+			log.Println("segment", s.seq, "failed:", s.err)
+			failed++
+		}
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Println("video", id, "downloaded,", failed, "segments failed")
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrVODIncomplete, failed, len(segments))
+	}
+	return nil
+}
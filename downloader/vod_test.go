@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cydev/twitch/api"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVODSegments(t *testing.T) {
+	Convey("VOD resume", t, func() {
+		dir, err := ioutil.TempDir("", "vod")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/index.m3u8" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n")
+			for i := 0; i < 200; i++ {
+				fmt.Fprintf(w, "#EXTINF:10.000,\n%d.ts\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		}))
+		defer srv.Close()
+
+		ledger, err := OpenLedger(filepath.Join(dir, "vod.ts.ledger"))
+		So(err, ShouldBeNil)
+		defer ledger.Close()
+		for seq := uint64(0); seq <= 150; seq++ {
+			if seq == 20 {
+				continue
+			}
+			So(ledger.Append(LedgerEntry{Seq: seq, URL: fmt.Sprintf("%s/%d.ts", srv.URL, seq)}), ShouldBeNil)
+		}
+		d := &Downloader{httpClient: srv.Client(), ledger: ledger}
+		segments, length, err := d.vodSegments(context.Background(), Stream{URL: srv.URL + "/index.m3u8"})
+		So(err, ShouldBeNil)
+		So(length, ShouldEqual, 2000*time.Second)
+		So(len(segments), ShouldEqual, 50)
+		So(segments[0].seq, ShouldEqual, 20)
+		So(segments[1].seq, ShouldEqual, 151)
+		So(segments[1].url, ShouldEqual, srv.URL+"/151.ts")
+
+		_, _, err = d.vodSegments(context.Background(), Stream{URL: srv.URL + "/missing.m3u8"})
+		So(errors.Is(err, api.ErrNotFound), ShouldBeTrue)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = d.vodSegments(ctx, Stream{URL: srv.URL + "/index.m3u8"})
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+	})
+}
+
+func TestVODMetadata(t *testing.T) {
+	Convey("VOD metadata has the video length", t, func() {
+		dir, err := ioutil.TempDir("", "vod")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		d := &Downloader{dir: dir, fileName: "vod.ts"}
+		d.metadata = Metadata{Date: date, Duration: time.Minute}
+		d.finishVODMetadata(2 * time.Hour)
+
+		f, err := os.Open(filepath.Join(dir, GetMetadataFileName("vod.ts")))
+		So(err, ShouldBeNil)
+		defer f.Close()
+		metadata, err := ReadMetadata(f)
+		So(err, ShouldBeNil)
+		So(metadata.Duration, ShouldEqual, 2*time.Hour)
+		So(metadata.End.Equal(date.Add(2*time.Hour)), ShouldBeTrue)
+		_, err = os.Stat(filepath.Join(dir, GetMetadataFileName("vod.ts")+".tmp"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
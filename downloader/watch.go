@@ -0,0 +1,86 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cydev/twitch/api"
+)
+
+var ErrStaleLiveness = errors.New("Liveness is not known")
+
+type liveChecker interface {
+	IsLiveContext(ctx context.Context, name string) (bool, error)
+}
+
+// watchList polls the liveness of every supervised channel with batched
+// requests and answers IsLive from the latest result.
+type watchList struct {
+	helix    api.Helix
+	mu       sync.Mutex
+	live     map[string]bool
+	updated  time.Time
+	err      error
+	now      func() time.Time
+	interval time.Duration
+}
+
+func newWatchList(helix api.Helix) *watchList {
+	return &watchList{helix: helix, now: time.Now, interval: checkInterval}
+}
+
+func (w *watchList) poll(ctx context.Context, channels []string) error {
+	live := make(map[string]bool)
+	var err error
+	for i := 0; i < len(channels) && err == nil; i += api.MaxLogins {
+		end := i + api.MaxLogins
+		if end > len(channels) {
+			end = len(channels)
+		}
+		var streams map[string]api.HelixStream
+		streams, err = w.helix.LiveStreamsContext(ctx, channels[i:end])
+		for login := range streams {
+			live[login] = true
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+	if err == nil {
+		w.live = live
+		w.updated = w.now()
+	}
+	return err
+}
+
+// IsLiveContext answers from the latest poll, so it never waits on ctx.
+func (w *watchList) IsLiveContext(ctx context.Context, name string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return false, w.err
+	}
+	if w.updated.IsZero() || w.now().Sub(w.updated) > 2*w.interval {
+		return false, ErrStaleLiveness
+	}
+	return w.live[strings.ToLower(name)], nil
+}
+
+func (w *watchList) loop(ctx context.Context, channels func() []string) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(ctx, channels()); err != nil && ctx.Err() == nil {
+			log.Println("liveness check failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cydev/twitch/api"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type streamsClient struct {
+	live     []string
+	requests []*http.Request
+}
+
+func (c *streamsClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req)
+	var data []string
+	for _, login := range req.URL.Query()["user_login"] {
+		for _, live := range c.live {
+			if login == live {
+				data = append(data, fmt.Sprintf(`{"id": "1", "user_login": %q, "type": "live"}`, login))
+			}
+		}
+	}
+	body := fmt.Sprintf(`{"data": [%s], "pagination": {}}`, strings.Join(data, ","))
+	res := &http.Response{StatusCode: http.StatusOK}
+	res.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+	return res, nil
+}
+
+func TestWatchList(t *testing.T) {
+	Convey("WatchList", t, func() {
+		client := &streamsClient{live: []string{"first", "channel149"}}
+		w := newWatchList(api.NewHelix(client, "client"))
+		now := time.Now()
+		w.now = func() time.Time { return now }
+
+		_, err := w.IsLiveContext(context.Background(), "first")
+		So(err, ShouldEqual, ErrStaleLiveness)
+
+		channels := []string{"First", "second"}
+		for i := 0; i < 150; i++ {
+			channels = append(channels, fmt.Sprintf("channel%d", i))
+		}
+		So(w.poll(context.Background(), channels), ShouldBeNil)
+		So(len(client.requests), ShouldEqual, 2)
+
+		live, err := w.IsLiveContext(context.Background(), "first")
+		So(err, ShouldBeNil)
+		So(live, ShouldBeTrue)
+		live, err = w.IsLiveContext(context.Background(), "second")
+		So(err, ShouldBeNil)
+		So(live, ShouldBeFalse)
+		live, err = w.IsLiveContext(context.Background(), "channel149")
+		So(err, ShouldBeNil)
+		So(live, ShouldBeTrue)
+
+		now = now.Add(3 * checkInterval)
+		_, err = w.IsLiveContext(context.Background(), "first")
+		So(err, ShouldEqual, ErrStaleLiveness)
+	})
+}
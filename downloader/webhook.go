@@ -0,0 +1,226 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Twitch-Get-Signature"
+	DeliveryHeader  = "X-Twitch-Get-Delivery"
+	TimestampHeader = "X-Twitch-Get-Timestamp"
+
+	webhookExtension = ".json"
+	webhookQueueDir  = "webhook-queue"
+	// webhookMaxDelay caps the retry delay of an unavailable receiver,
+	// which may stay down far longer than a segment server.
+	webhookMaxDelay = 10 * time.Minute
+)
+
+type webhookPayload struct {
+	ID       string    `json:"id"`
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Channel  string    `json:"channel,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Fatal    bool      `json:"fatal,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// Webhook posts events as JSON signed with HMAC-SHA256 to an HTTP endpoint.
+// Events are queued on disk and delivered in order by Run, so they survive
+// receiver downtime and restarts.
+type Webhook struct {
+	url    string
+	secret []byte
+	client HTTPClient
+	dir    string
+	wake   chan struct{}
+	seq    uint64
+	mu     sync.Mutex
+}
+
+// NewWebhook queues events in queueDir, or next to the recordings when it
+// is empty.
+func NewWebhook(client HTTPClient, url, secret, queueDir string) (*Webhook, error) {
+	if len(queueDir) == 0 {
+		queueDir = filepath.Join(workdir, webhookQueueDir)
+	}
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Webhook{
+		url:    url,
+		secret: []byte(secret),
+		client: client,
+		dir:    queueDir,
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Sign returns the signature header value for body sent at timestamp, the
+// TimestampHeader value. Receivers should reject stale timestamps, so a
+// captured delivery can not be replayed.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) Notify(message string) error {
+	return w.NotifyEvent(Event{Type: EventMessage, Time: time.Now(), Message: message})
+}
+
+// NotifyEvent queues the event for delivery.
+func (w *Webhook) NotifyEvent(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	id := fmt.Sprintf("%019d-%06d", event.Time.UnixNano(), atomic.AddUint64(&w.seq, 1))
+	body, err := json.Marshal(webhookPayload{
+		ID:       id,
+		Type:     event.Type,
+		Time:     event.Time,
+		Channel:  event.Channel,
+		File:     event.File,
+		Duration: event.Duration.Seconds(),
+		Size:     event.Size,
+		Metadata: event.Metadata,
+		Error:    event.Error,
+		Fatal:    event.Fatal,
+		Message:  event.Message,
+	})
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(w.dir, id+webhookExtension)
+	if err := ioutil.WriteFile(name+".tmp", body, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *Webhook) post(ctx context.Context, id string, body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, id)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(w.secret, timestamp, body))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return StatusError{URL: w.url, StatusCode: res.StatusCode}
+	}
+	return nil
+}
+
+// permanent reports whether retrying a delivery can not help.
+func permanent(err error) bool {
+	status, ok := err.(StatusError)
+	if !ok {
+		return false
+	}
+	switch status.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status.StatusCode >= 400 && status.StatusCode < 500
+}
+
+// Queued returns the number of events waiting for delivery.
+func (w *Webhook) Queued() int {
+	names, _ := filepath.Glob(filepath.Join(w.dir, "*"+webhookExtension))
+	return len(names)
+}
+
+// Flush delivers queued events in order and stops at the first failure.
+// Events the receiver rejects with a client error are dropped.
+func (w *Webhook) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(w.dir, "*"+webhookExtension))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		id := filepath.Base(name[:len(name)-len(webhookExtension)])
+		if err := w.post(ctx, id, body); err != nil {
+			if !permanent(err) {
+				return err
+			}
+			log.Println("webhook rejected event", id, err)
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run delivers queued events until ctx is done, retrying with backoff while
+// the receiver is unavailable. Events queued during a retry delay wait for
+// it to pass, so they do not bring the retries forward.
+func (w *Webhook) Run(ctx context.Context) {
+	attempt := 0
+	for {
+		if err := w.Flush(ctx); err != nil && ctx.Err() == nil {
+			delay := backoffUpTo(attempt, webhookMaxDelay)
+			log.Println("webhook delivery failed, retrying in", delay, "after", err)
+			attempt++
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		attempt = 0
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+	}
+}
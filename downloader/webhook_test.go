@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests int
+	payloads []webhookPayload
+	valid    bool
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.status != http.StatusOK {
+		w.WriteHeader(r.status)
+		return
+	}
+	var p webhookPayload
+	json.Unmarshal(body, &p)
+	timestamp := req.Header.Get(TimestampHeader)
+	sent, _ := strconv.ParseInt(timestamp, 10, 64)
+	r.valid = req.Header.Get(SignatureHeader) == Sign([]byte("secret"), timestamp, body) &&
+		time.Since(time.Unix(sent, 0)) < time.Minute &&
+		req.Header.Get(DeliveryHeader) == p.ID
+	r.payloads = append(r.payloads, p)
+}
+
+func (r *webhookReceiver) attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func (r *webhookReceiver) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.payloads)
+}
+
+func TestWebhook(t *testing.T) {
+	Convey("Webhook", t, func() {
+		dir, err := ioutil.TempDir("", "webhook")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		receiver := &webhookReceiver{status: http.StatusServiceUnavailable}
+		srv := httptest.NewServer(receiver)
+		defer srv.Close()
+		hook, err := NewWebhook(srv.Client(), srv.URL, "secret", dir)
+		So(err, ShouldBeNil)
+
+		start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		So(hook.NotifyEvent(Event{
+			Type:     EventStarted,
+			Time:     start,
+			Channel:  "streamer",
+			File:     "streamer.ts",
+			Metadata: &Metadata{Title: "title", StreamID: 42},
+		}), ShouldBeNil)
+		So(hook.NotifyEvent(Event{
+			Type:     EventFinished,
+			Time:     start.Add(time.Hour),
+			Channel:  "streamer",
+			Duration: 90 * time.Minute,
+			Size:     1024,
+		}), ShouldBeNil)
+
+		Convey("Queue while receiver is down", func() {
+			_, ok := hook.Flush(context.Background()).(StatusError)
+			So(ok, ShouldBeTrue)
+			So(hook.Queued(), ShouldEqual, 2)
+
+			hook, err = NewWebhook(srv.Client(), srv.URL, "secret", dir)
+			So(err, ShouldBeNil)
+			So(hook.Queued(), ShouldEqual, 2)
+			receiver.mu.Lock()
+			receiver.status = http.StatusOK
+			receiver.mu.Unlock()
+			So(hook.Flush(context.Background()), ShouldBeNil)
+			So(hook.Queued(), ShouldEqual, 0)
+
+			So(receiver.valid, ShouldBeTrue)
+			So(len(receiver.payloads), ShouldEqual, 2)
+			started, finished := receiver.payloads[0], receiver.payloads[1]
+			So(started.Type, ShouldEqual, EventStarted)
+			So(started.Channel, ShouldEqual, "streamer")
+			So(started.File, ShouldEqual, "streamer.ts")
+			So(started.Metadata.StreamID, ShouldEqual, 42)
+			So(finished.Type, ShouldEqual, EventFinished)
+			So(finished.Duration, ShouldEqual, 5400)
+			So(finished.Size, ShouldEqual, 1024)
+		})
+		Convey("Drop rejected", func() {
+			receiver.status = http.StatusBadRequest
+			So(hook.Flush(context.Background()), ShouldBeNil)
+			So(hook.Queued(), ShouldEqual, 0)
+		})
+		Convey("Run", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				hook.Run(ctx)
+				close(done)
+			}()
+			receiver.mu.Lock()
+			receiver.status = http.StatusOK
+			receiver.mu.Unlock()
+			waitFor(func() bool { return receiver.received() == 2 })
+			So(hook.Notify("hello"), ShouldBeNil)
+			waitFor(func() bool { return receiver.received() == 3 })
+			cancel()
+			<-done
+			So(receiver.payloads[2].Type, ShouldEqual, EventMessage)
+			So(receiver.payloads[2].Message, ShouldEqual, "hello")
+		})
+		Convey("New events wait for the retry delay", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				hook.Run(ctx)
+				close(done)
+			}()
+			waitFor(func() bool { return receiver.attempts() == 1 })
+			for i := 0; i < 3; i++ {
+				So(hook.Notify("hello"), ShouldBeNil)
+			}
+			time.Sleep(retryBaseDelay / 4)
+			So(receiver.attempts(), ShouldEqual, 1)
+			receiver.mu.Lock()
+			receiver.status = http.StatusOK
+			receiver.mu.Unlock()
+			waitFor(func() bool { return receiver.received() == 5 })
+			cancel()
+			<-done
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package mp4
+
+import (
+	"errors"
+)
+
+const samplesPerFrame = 1024
+
+var (
+	ErrBadADTS = errors.New("Bad ADTS header")
+
+	sampleRates = []int{
+		96000, 88200, 64000, 48000, 44100, 32000,
+		24000, 22050, 16000, 12000, 11025, 8000, 7350,
+	}
+)
+
+type AudioConfig struct {
+	ObjectType      uint8
+	SampleRateIndex uint8
+	Channels        uint8
+}
+
+func (c AudioConfig) SampleRate() int {
+	if int(c.SampleRateIndex) >= len(sampleRates) {
+		return 0
+	}
+	return sampleRates[c.SampleRateIndex]
+}
+
+// Bytes returns the AudioSpecificConfig for the esds box.
+func (c AudioConfig) Bytes() []byte {
+	return []byte{
+		c.ObjectType<<3 | c.SampleRateIndex>>1,
+		c.SampleRateIndex<<7 | c.Channels<<3,
+	}
+}
+
+// SplitADTS strips ADTS headers from a buffer of AAC frames and returns
+// the raw frames along with the decoder configuration of the first one.
+func SplitADTS(data []byte) (frames [][]byte, config AudioConfig, err error) {
+	for len(data) > 0 {
+		if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return frames, config, ErrBadADTS
+		}
+		headerLength := 7
+		if data[1]&0x01 == 0 {
+			headerLength = 9
+		}
+		frameLength := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if frameLength < headerLength || frameLength > len(data) {
+			return frames, config, ErrBadADTS
+		}
+		if len(frames) == 0 {
+			config = AudioConfig{
+				ObjectType:      data[2]>>6 + 1,
+				SampleRateIndex: data[2] >> 2 & 0x0f,
+				Channels:        data[2]&0x01<<2 | data[3]>>6,
+			}
+		}
+		frames = append(frames, data[headerLength:frameLength])
+		data = data[frameLength:]
+	}
+	return frames, config, nil
+}
@@ -0,0 +1,264 @@
+package mp4
+
+import (
+	"errors"
+)
+
+const (
+	naluIDR = 5
+	naluSEI = 6
+	naluSPS = 7
+	naluPPS = 8
+	naluAUD = 9
+)
+
+var ErrBadSPS = errors.New("Bad SPS")
+
+// SplitNALUs splits an Annex B byte stream into NAL units.
+func SplitNALUs(data []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+func avcConfig(sps, pps []byte) []byte {
+	b := make(buffer, 0, 11+len(sps)+len(pps))
+	b.u8(1).u8(sps[1]).u8(sps[2]).u8(sps[3])
+	b.u8(0xff).u8(0xe1)
+	b.u16(uint16(len(sps))).bytes(sps)
+	b.u8(1).u16(uint16(len(pps))).bytes(pps)
+	return b
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, ErrBadSPS
+	}
+	v := uint(r.data[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return v, nil
+}
+
+func (r *bitReader) bits(n int) (v uint, err error) {
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, ErrBadSPS
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<uint(zeros) - 1 + v, err
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2, err
+	}
+	return -int(v / 2), err
+}
+
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// ParseSPS returns the picture dimensions from an H.264 sequence parameter set.
+func ParseSPS(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, ErrBadSPS
+	}
+	r := &bitReader{data: unescapeRBSP(sps[1:])}
+	profile, err := r.bits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.bits(16)
+	r.ue()
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.bit()
+		}
+		r.ue()
+		r.ue()
+		r.bit()
+		present, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				flag, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if flag == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+	r.ue()
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		r.ue()
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		cycle, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.bit()
+	widthMbs, _ := r.ue()
+	heightMaps, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.bit()
+	}
+	r.bit()
+	width = int(widthMbs+1) * 16
+	height = int(2-frameMbsOnly) * int(heightMaps+1) * 16
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		unitX, unitY := 1, int(2-frameMbsOnly)
+		if chromaFormat == 1 || chromaFormat == 2 {
+			unitX = 2
+		}
+		if chromaFormat == 1 {
+			unitY *= 2
+		}
+		width -= int(left+right) * unitX
+		height -= int(top+bottom) * unitY
+	}
+	return width, height, nil
+}
+
+// avcSample converts an Annex B access unit to a length prefixed sample,
+// dropping delimiters and parameter sets that are already in avcC.
+func avcSample(nalus [][]byte) (sample []byte, key bool) {
+	b := make(buffer, 0)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluAUD, naluSPS, naluPPS:
+			continue
+		case naluIDR:
+			key = true
+		}
+		b.u32(uint32(len(nalu))).bytes(nalu)
+	}
+	return b, key
+}
@@ -0,0 +1,124 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrBadBox = errors.New("Bad box")
+
+type buffer []byte
+
+func (b *buffer) u8(v uint8) *buffer {
+	*b = append(*b, v)
+	return b
+}
+
+func (b *buffer) u16(v uint16) *buffer {
+	*b = append(*b, byte(v>>8), byte(v))
+	return b
+}
+
+func (b *buffer) u24(v uint32) *buffer {
+	*b = append(*b, byte(v>>16), byte(v>>8), byte(v))
+	return b
+}
+
+func (b *buffer) u32(v uint32) *buffer {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+	return b
+}
+
+func (b *buffer) u64(v uint64) *buffer {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+	return b
+}
+
+func (b *buffer) bytes(v []byte) *buffer {
+	*b = append(*b, v...)
+	return b
+}
+
+func (b *buffer) zero(n int) *buffer {
+	*b = append(*b, make([]byte, n)...)
+	return b
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make(buffer, 0, size)
+	b.u32(uint32(size)).bytes([]byte(typ))
+	for _, p := range payload {
+		b.bytes(p)
+	}
+	return b
+}
+
+// readBoxHeader reads a box header and returns the type and payload size.
+func readBoxHeader(r io.Reader) (typ string, size uint64, err error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	typ = string(header[4:])
+	size = uint64(binary.BigEndian.Uint32(header))
+	switch {
+	case size == 1:
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", 0, err
+		}
+		size = binary.BigEndian.Uint64(header)
+		if size < 16 {
+			return "", 0, ErrBadBox
+		}
+		return typ, size - 16, nil
+	case size < 8:
+		return "", 0, ErrBadBox
+	}
+	return typ, size - 8, nil
+}
+
+// childBoxes splits a container box payload into its children.
+func childBoxes(data []byte) (children map[string][][]byte, err error) {
+	children = make(map[string][][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrBadBox
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil, ErrBadBox
+		}
+		typ := string(data[4:8])
+		children[typ] = append(children[typ], data[8:size])
+		data = data[size:]
+	}
+	return children, nil
+}
+
+// skip discards n bytes of r.
+func skip(r io.Reader, n uint64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(int64(n), io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, int64(n))
+	return err
+}
+
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := make(buffer, 0, 4)
+	header.u8(version).u24(flags)
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+var matrix = func() []byte {
+	b := make(buffer, 0, 36)
+	b.u32(0x00010000).zero(12).u32(0x00010000).zero(12).u32(0x40000000)
+	return b
+}()
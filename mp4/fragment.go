@@ -0,0 +1,240 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/cydev/twitch/ts"
+)
+
+const (
+	maxTimestampJump = 10 * Timescale
+
+	sampleFlagsKey    = 0x02000000
+	sampleFlagsNonKey = 0x01010000
+
+	trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800
+)
+
+var (
+	ErrNewTrack = errors.New("Track is missing from the init segment")
+	ErrNoInit   = errors.New("No init segment")
+)
+
+// InitSegment returns ftyp and moov boxes of a fragmented MP4 for tracks.
+func InitSegment(tracks []*Track, created time.Time) []byte {
+	var (
+		traks [][]byte
+		trex  [][]byte
+	)
+	for _, t := range tracks {
+		traks = append(traks, trak(t, created, 0, emptySampleTable(t)))
+		b := make(buffer, 0, 20)
+		b.u32(t.ID).u32(1).u32(0).u32(0).u32(0)
+		trex = append(trex, fullBox("trex", 0, 0, b))
+	}
+	moov := append([][]byte{mvhd(created, 0, uint32(len(tracks)+1))}, traks...)
+	moov = append(moov, box("mvex", trex...))
+	return append(ftyp("iso5", "iso5", "iso6", "mp41"), box("moov", moov...)...)
+}
+
+func traf(t *Track, decodeTime uint64, dataOffset int32) []byte {
+	header := make(buffer, 0, 4)
+	header.u32(t.ID)
+	tfdt := make(buffer, 0, 8)
+	tfdt.u64(decodeTime)
+	run := make(buffer, 0, 8+16*len(t.Samples))
+	run.u32(uint32(len(t.Samples))).u32(uint32(dataOffset))
+	for _, s := range t.Samples {
+		flags := uint32(sampleFlagsNonKey)
+		if s.Key {
+			flags = sampleFlagsKey
+		}
+		run.u32(s.Duration).u32(uint32(len(s.Data))).u32(flags).u32(uint32(s.Offset))
+	}
+	return box("traf",
+		fullBox("tfhd", 0, 0x020000, header),
+		fullBox("tfdt", 1, 0, tfdt),
+		fullBox("trun", 1, trunFlags, run),
+	)
+}
+
+func moof(sequence uint32, tracks []*Track, decodeTimes []uint64, base int) []byte {
+	mfhd := make(buffer, 0, 4)
+	mfhd.u32(sequence)
+	boxes := [][]byte{fullBox("mfhd", 0, 0, mfhd)}
+	offset := base
+	for i, t := range tracks {
+		boxes = append(boxes, traf(t, decodeTimes[i], int32(offset)))
+		offset += t.size()
+	}
+	return box("moof", boxes...)
+}
+
+// FragmentWriter writes each segment as a moof and mdat pair, so the file
+// stays playable while it grows. Decode times are kept continuous across
+// timestamp wraps and discontinuities. The init segment describes the
+// tracks of the first fragment; a track that shows up later is an error.
+type FragmentWriter struct {
+	w           io.Writer
+	sequence    uint32
+	base        uint64
+	offset      uint64
+	next        uint64
+	started     bool
+	initialized bool
+	tracks      map[uint32]bool
+	lastDTS     uint64
+	lastTime    uint64
+}
+
+func NewFragmentWriter(w io.Writer) *FragmentWriter {
+	return &FragmentWriter{w: w}
+}
+
+// InitTracks returns the track IDs of the init segment at the start of r.
+func InitTracks(r io.Reader) (ids []uint32, err error) {
+	for {
+		typ, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return nil, ErrNoInit
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ != "moov" {
+			if err := skip(r, size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		moov := make([]byte, size)
+		if _, err := io.ReadFull(r, moov); err != nil {
+			return nil, err
+		}
+		boxes, err := childBoxes(moov)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range boxes["trak"] {
+			trak, err := childBoxes(t)
+			if err != nil {
+				return nil, err
+			}
+			if len(trak["tkhd"]) == 0 {
+				return nil, ErrBadBox
+			}
+			tkhd := trak["tkhd"][0]
+			offset := 12
+			if len(tkhd) > 0 && tkhd[0] == 1 {
+				offset = 20
+			}
+			if len(tkhd) < offset+4 {
+				return nil, ErrBadBox
+			}
+			ids = append(ids, binary.BigEndian.Uint32(tkhd[offset:]))
+		}
+		return ids, nil
+	}
+}
+
+// Resume continues a file that already has an init segment with the
+// tracks and sequence fragments, the last of which started at dts and
+// decode time.
+func (f *FragmentWriter) Resume(sequence uint32, dts, decodeTime uint64, tracks []uint32) {
+	f.initialized = true
+	f.started = true
+	if len(tracks) > 0 {
+		f.tracks = make(map[uint32]bool, len(tracks))
+		for _, id := range tracks {
+			f.tracks[id] = true
+		}
+	}
+	f.sequence = sequence
+	f.base = dts
+	f.offset = decodeTime
+	f.lastDTS, f.lastTime = dts, decodeTime
+}
+
+// Last returns the first DTS and decode time of the last written fragment.
+func (f *FragmentWriter) Last() (dts, decodeTime uint64) {
+	return f.lastDTS, f.lastTime
+}
+
+func (f *FragmentWriter) decodeTime(base, offset, dts uint64) uint64 {
+	return (dts-base)&ts.TimestampMask + offset
+}
+
+// WriteFragment writes the tracks as one fragment. The writer state only
+// advances when the write succeeds, so a failed fragment can be retried
+// after the output is truncated back.
+func (f *FragmentWriter) WriteFragment(tracks []*Track) (written int64, err error) {
+	if len(tracks) == 0 {
+		return 0, ErrNoTracks
+	}
+	if f.tracks != nil {
+		for _, t := range tracks {
+			if !f.tracks[t.ID] {
+				return 0, ErrNewTrack
+			}
+		}
+	}
+	first := tracks[0].Samples[0].DTS
+	for _, t := range tracks[1:] {
+		if d := t.Samples[0].DTS; (first-d)&ts.TimestampMask < maxTimestampJump {
+			first = d
+		}
+	}
+	base, offset := f.base, f.offset
+	if !f.started {
+		base = first
+	}
+	if f.next > 0 {
+		t := f.decodeTime(base, offset, first)
+		if t > f.next+maxTimestampJump || t+maxTimestampJump < f.next {
+			offset += f.next - t
+		}
+	}
+	var (
+		decodeTimes = make([]uint64, len(tracks))
+		mdatSize    = 8
+		sequence    = f.sequence + 1
+	)
+	for i, t := range tracks {
+		decodeTimes[i] = f.decodeTime(base, offset, t.Samples[0].DTS)
+		mdatSize += t.size()
+	}
+	var out []byte
+	if !f.initialized {
+		out = InitSegment(tracks, time.Now())
+	}
+	header := moof(sequence, tracks, decodeTimes, 0)
+	header = moof(sequence, tracks, decodeTimes, len(header)+8)
+	out = append(out, header...)
+	mdat := make(buffer, 0, mdatSize)
+	mdat.u32(uint32(mdatSize)).bytes([]byte("mdat"))
+	for _, t := range tracks {
+		for _, s := range t.Samples {
+			mdat.bytes(s.Data)
+		}
+	}
+	out = append(out, mdat...)
+	n, err := f.w.Write(out)
+	if err != nil {
+		return int64(n), err
+	}
+	if !f.initialized {
+		f.initialized = true
+		f.tracks = make(map[uint32]bool, len(tracks))
+		for _, t := range tracks {
+			f.tracks[t.ID] = true
+		}
+	}
+	f.started = true
+	f.base, f.offset, f.sequence = base, offset, sequence
+	f.next = decodeTimes[0] + tracks[0].Duration()
+	f.lastDTS, f.lastTime = first, f.decodeTime(base, offset, first)
+	return int64(n), nil
+}
@@ -0,0 +1,173 @@
+package mp4
+
+import (
+	"math"
+	"time"
+)
+
+const movieTimescale = 1000
+
+var epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func mp4Time(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint32(t.Sub(epoch) / time.Second)
+}
+
+func ftyp(major string, compatible ...string) []byte {
+	b := make(buffer, 0)
+	b.bytes([]byte(major)).u32(0x200)
+	for _, c := range compatible {
+		b.bytes([]byte(c))
+	}
+	return box("ftyp", b)
+}
+
+// version returns the full box version for a duration: version 1 boxes
+// have 64-bit times and duration, needed from 2^32 timescale units on.
+func version(duration uint64) uint8 {
+	if duration > math.MaxUint32 {
+		return 1
+	}
+	return 0
+}
+
+func (b *buffer) u32or64(v uint64, version uint8) *buffer {
+	if version == 1 {
+		return b.u64(v)
+	}
+	return b.u32(uint32(v))
+}
+
+func mvhd(created time.Time, duration uint64, nextTrack uint32) []byte {
+	d := duration * movieTimescale / Timescale
+	v := version(d)
+	b := make(buffer, 0, 108)
+	b.u32or64(uint64(mp4Time(created)), v).u32or64(uint64(mp4Time(created)), v).u32(movieTimescale)
+	b.u32or64(d, v)
+	b.u32(0x00010000).u16(0x0100).zero(10)
+	b.bytes(matrix).zero(24).u32(nextTrack)
+	return fullBox("mvhd", v, 0, b)
+}
+
+func tkhd(t *Track, created time.Time, duration uint64) []byte {
+	d := duration * movieTimescale / Timescale
+	v := version(d)
+	b := make(buffer, 0, 92)
+	b.u32or64(uint64(mp4Time(created)), v).u32or64(uint64(mp4Time(created)), v).u32(t.ID).zero(4)
+	b.u32or64(d, v).zero(8)
+	b.u16(0).u16(0)
+	if t.IsVideo() {
+		b.u16(0)
+	} else {
+		b.u16(0x0100)
+	}
+	b.zero(2).bytes(matrix)
+	b.u32(uint32(t.Width) << 16).u32(uint32(t.Height) << 16)
+	return fullBox("tkhd", v, 3, b)
+}
+
+func mdhd(created time.Time, duration uint64) []byte {
+	v := version(duration)
+	b := make(buffer, 0, 32)
+	b.u32or64(uint64(mp4Time(created)), v).u32or64(uint64(mp4Time(created)), v).u32(Timescale)
+	b.u32or64(duration, v).u16(0x55c4).u16(0)
+	return fullBox("mdhd", v, 0, b)
+}
+
+func hdlr(t *Track) []byte {
+	name := "VideoHandler"
+	if !t.IsVideo() {
+		name = "SoundHandler"
+	}
+	b := make(buffer, 0, 32)
+	b.zero(4).bytes([]byte(t.Handler)).zero(12).bytes([]byte(name)).u8(0)
+	return fullBox("hdlr", 0, 0, b)
+}
+
+func avc1(t *Track) []byte {
+	b := make(buffer, 0, 86)
+	b.zero(6).u16(1).zero(16)
+	b.u16(uint16(t.Width)).u16(uint16(t.Height))
+	b.u32(0x00480000).u32(0x00480000).zero(4).u16(1).zero(32)
+	b.u16(0x0018).u16(0xffff)
+	return box("avc1", b, box("avcC", t.Config))
+}
+
+func descriptor(tag uint8, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make(buffer, 0, size+2)
+	b.u8(tag).u8(uint8(size))
+	for _, p := range payload {
+		b.bytes(p)
+	}
+	return b
+}
+
+func mp4a(t *Track) []byte {
+	b := make(buffer, 0, 28)
+	b.zero(6).u16(1).zero(8)
+	b.u16(uint16(t.Audio.Channels)).u16(16).zero(4)
+	b.u32(uint32(t.Audio.SampleRate()) << 16)
+
+	decoder := make(buffer, 0, 13)
+	decoder.u8(0x40).u8(0x15).u24(0).u32(0).u32(0)
+	es := make(buffer, 0, 3)
+	es.u16(uint16(t.ID)).u8(0)
+	esds := descriptor(3, es,
+		descriptor(4, decoder, descriptor(5, t.Config)),
+		descriptor(6, []byte{0x02}),
+	)
+	return box("mp4a", b, fullBox("esds", 0, 0, esds))
+}
+
+func stsd(t *Track) []byte {
+	entry := mp4a(t)
+	if t.IsVideo() {
+		entry = avc1(t)
+	}
+	b := make(buffer, 0, 4)
+	b.u32(1)
+	return fullBox("stsd", 0, 0, b, entry)
+}
+
+func emptyTable(typ string, fields int) []byte {
+	b := make(buffer, 0, 4*fields)
+	b.zero(4 * fields)
+	return fullBox(typ, 0, 0, b)
+}
+
+func emptySampleTable(t *Track) []byte {
+	return box("stbl",
+		stsd(t),
+		emptyTable("stts", 1),
+		emptyTable("stsc", 1),
+		emptyTable("stsz", 2),
+		emptyTable("stco", 1),
+	)
+}
+
+func minf(t *Track, stbl []byte) []byte {
+	var header []byte
+	if t.IsVideo() {
+		header = fullBox("vmhd", 0, 1, make([]byte, 8))
+	} else {
+		header = fullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	ref := make(buffer, 0, 4)
+	ref.u32(1)
+	dinf := box("dinf", fullBox("dref", 0, 0, ref, fullBox("url ", 0, 1)))
+	return box("minf", header, dinf, stbl)
+}
+
+func trak(t *Track, created time.Time, duration uint64, stbl []byte) []byte {
+	return box("trak",
+		tkhd(t, created, duration),
+		box("mdia", mdhd(created, duration), hdlr(t), minf(t, stbl)),
+	)
+}
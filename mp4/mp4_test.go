@@ -0,0 +1,456 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cydev/twitch/ts"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type bitWriter struct {
+	data []byte
+	n    uint
+}
+
+func (w *bitWriter) bit(v uint) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= byte(v&1) << (7 - w.n%8)
+	w.n++
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(v >> uint(i))
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+func escapeRBSP(data []byte) (out []byte) {
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func testSPS(width, height int) []byte {
+	w := &bitWriter{}
+	w.bits(66, 8)
+	w.bits(0, 8)
+	w.bits(31, 8)
+	w.ue(0)
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bit(0)
+	mbsWidth, mbsHeight := (width+15)/16, (height+15)/16
+	w.ue(uint(mbsWidth - 1))
+	w.ue(uint(mbsHeight - 1))
+	w.bit(1)
+	w.bit(1)
+	if cropX, cropY := mbsWidth*16-width, mbsHeight*16-height; cropX > 0 || cropY > 0 {
+		w.bit(1)
+		w.ue(0)
+		w.ue(uint(cropX / 2))
+		w.ue(0)
+		w.ue(uint(cropY / 2))
+	} else {
+		w.bit(0)
+	}
+	w.bit(0)
+	w.bit(1)
+	return append([]byte{0x67}, escapeRBSP(w.data)...)
+}
+
+func adts(payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte{
+		0xff, 0xf1,
+		1<<6 | 4<<2 | 0,
+		2<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length<<5) | 0x1f,
+		0xfc,
+	}
+	return append(header, payload...)
+}
+
+func testSegment(start uint64, frames int) []byte {
+	var (
+		out bytes.Buffer
+		w   = ts.NewWriter(&out)
+		sps = testSPS(1920, 1080)
+		pps = []byte{0x68, 0xce, 0x38, 0x80}
+	)
+	for i := 0; i < frames; i++ {
+		dts := start + uint64(i*3000)
+		var au []byte
+		au = append(au, 0, 0, 0, 1, 0x09, 0xf0)
+		if i == 0 {
+			au = append(au, 0, 0, 0, 1)
+			au = append(au, sps...)
+			au = append(au, 0, 0, 0, 1)
+			au = append(au, pps...)
+			au = append(au, 0, 0, 1, 0x65)
+		} else {
+			au = append(au, 0, 0, 1, 0x41)
+		}
+		au = append(au, bytes.Repeat([]byte{0xab}, 300)...)
+		So(w.WritePacket(ts.Packet{
+			Type:         ts.StreamH264,
+			PTS:          dts + 6000,
+			DTS:          dts,
+			RandomAccess: i == 0,
+			Data:         au,
+		}), ShouldBeNil)
+		if i%2 == 0 {
+			var frames []byte
+			for j := 0; j < 3; j++ {
+				frames = append(frames, adts(bytes.Repeat([]byte{byte(j)}, 20))...)
+			}
+			So(w.WritePacket(ts.Packet{
+				Type: ts.StreamAAC,
+				PTS:  dts,
+				DTS:  dts,
+				Data: frames,
+			}), ShouldBeNil)
+		}
+	}
+	return out.Bytes()
+}
+
+type testBox struct {
+	typ  string
+	data []byte
+}
+
+func readBoxes(data []byte) (boxes []testBox) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		So(size, ShouldBeGreaterThanOrEqualTo, 8)
+		So(size, ShouldBeLessThanOrEqualTo, len(data))
+		boxes = append(boxes, testBox{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	So(len(data), ShouldEqual, 0)
+	return boxes
+}
+
+func boxTypes(boxes []testBox) (types []string) {
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	return types
+}
+
+func TestSPS(t *testing.T) {
+	Convey("SPS", t, func() {
+		for _, size := range [][2]int{{1920, 1080}, {1280, 720}, {852, 480}} {
+			width, height, err := ParseSPS(testSPS(size[0], size[1]))
+			So(err, ShouldBeNil)
+			So(width, ShouldEqual, size[0])
+			So(height, ShouldEqual, size[1])
+		}
+	})
+}
+
+func TestADTS(t *testing.T) {
+	Convey("ADTS", t, func() {
+		data := append(adts([]byte{1, 2, 3}), adts([]byte{4, 5})...)
+		frames, config, err := SplitADTS(data)
+		So(err, ShouldBeNil)
+		So(len(frames), ShouldEqual, 2)
+		So(frames[1], ShouldResemble, []byte{4, 5})
+		So(config.SampleRate(), ShouldEqual, 44100)
+		So(config.Channels, ShouldEqual, 2)
+		So(config.Bytes(), ShouldResemble, []byte{0x12, 0x10})
+		_, _, err = SplitADTS([]byte{1, 2, 3})
+		So(err, ShouldEqual, ErrBadADTS)
+	})
+}
+
+func TestReadTS(t *testing.T) {
+	Convey("ReadTS", t, func() {
+		data := testSegment(900000, 10)
+		So(ts.IsTS(data), ShouldBeTrue)
+		tracks, err := ReadTS(data)
+		So(err, ShouldBeNil)
+		So(len(tracks), ShouldEqual, 2)
+		video, audio := tracks[0], tracks[1]
+		So(video.IsVideo(), ShouldBeTrue)
+		So(video.Width, ShouldEqual, 1920)
+		So(video.Height, ShouldEqual, 1080)
+		So(len(video.Samples), ShouldEqual, 10)
+		So(video.Samples[0].Key, ShouldBeTrue)
+		So(video.Samples[1].Key, ShouldBeFalse)
+		So(video.Samples[0].Offset, ShouldEqual, 6000)
+		So(video.Samples[9].Duration, ShouldEqual, 3000)
+		So(len(audio.Samples), ShouldEqual, 15)
+		So(audio.Samples[0].Duration, ShouldEqual, 2089)
+		So(audio.Audio.SampleRate(), ShouldEqual, 44100)
+	})
+}
+
+func TestFragmentWriter(t *testing.T) {
+	Convey("FragmentWriter", t, func() {
+		var out bytes.Buffer
+		f := NewFragmentWriter(&out)
+		tracks, err := ReadTS(testSegment(900000, 10))
+		So(err, ShouldBeNil)
+		n, err := f.WriteFragment(tracks)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, out.Len())
+		So(boxTypes(readBoxes(out.Bytes())), ShouldResemble, []string{"ftyp", "moov", "moof", "mdat"})
+		dts, decodeTime := f.Last()
+		So(dts, ShouldEqual, 900000)
+		So(decodeTime, ShouldEqual, 0)
+
+		Convey("Continuous", func() {
+			out.Reset()
+			tracks, err := ReadTS(testSegment(930000, 10))
+			So(err, ShouldBeNil)
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldBeNil)
+			boxes := readBoxes(out.Bytes())
+			So(boxTypes(boxes), ShouldResemble, []string{"moof", "mdat"})
+			_, decodeTime := f.Last()
+			So(decodeTime, ShouldEqual, 30000)
+
+			traf := readBoxes(boxes[0].data[16:])[0]
+			So(traf.typ, ShouldEqual, "traf")
+			trun := readBoxes(traf.data)[2]
+			So(trun.typ, ShouldEqual, "trun")
+			dataOffset := int(binary.BigEndian.Uint32(trun.data[8:]))
+			So(dataOffset, ShouldEqual, len(boxes[0].data)+16)
+			sampleSize := binary.BigEndian.Uint32(trun.data[16:])
+			So(binary.BigEndian.Uint32(out.Bytes()[dataOffset:]), ShouldEqual, sampleSize-4)
+		})
+		Convey("Discontinuity", func() {
+			tracks, err := ReadTS(testSegment(100, 10))
+			So(err, ShouldBeNil)
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldBeNil)
+			_, decodeTime := f.Last()
+			So(decodeTime, ShouldEqual, 30000)
+		})
+		Convey("New track", func() {
+			tracks, err := ReadTS(testSegment(930000, 10))
+			So(err, ShouldBeNil)
+			tracks[1].ID = 3
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldEqual, ErrNewTrack)
+		})
+		Convey("Resume", func() {
+			out.Reset()
+			f := NewFragmentWriter(&out)
+			ids, err := InitTracks(bytes.NewReader(InitSegment(tracks, time.Now())))
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []uint32{1, 2})
+			f.Resume(5, 900000, 120000, ids)
+			tracks, err := ReadTS(testSegment(930000, 10))
+			So(err, ShouldBeNil)
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldBeNil)
+			So(boxTypes(readBoxes(out.Bytes())), ShouldResemble, []string{"moof", "mdat"})
+			_, decodeTime := f.Last()
+			So(decodeTime, ShouldEqual, 150000)
+
+			tracks[1].ID = 3
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldEqual, ErrNewTrack)
+		})
+	})
+}
+
+type failingWriter struct{ fail bool }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+func TestFragmentWriterFailure(t *testing.T) {
+	Convey("FragmentWriter keeps state when a write fails", t, func() {
+		w := &failingWriter{fail: true}
+		f := NewFragmentWriter(w)
+		tracks, err := ReadTS(testSegment(900000, 10))
+		So(err, ShouldBeNil)
+		_, err = f.WriteFragment(tracks)
+		So(err, ShouldEqual, io.ErrShortWrite)
+
+		var out bytes.Buffer
+		f.w = &out
+		_, err = f.WriteFragment(tracks)
+		So(err, ShouldBeNil)
+		So(boxTypes(readBoxes(out.Bytes())), ShouldResemble, []string{"ftyp", "moov", "moof", "mdat"})
+		mfhd := readBoxes(readBoxes(out.Bytes())[2].data)[0]
+		So(binary.BigEndian.Uint32(mfhd.data[4:]), ShouldEqual, 1)
+	})
+}
+
+func findBox(boxes []testBox, path ...string) testBox {
+	for _, b := range boxes {
+		if b.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b
+		}
+		return findBox(readBoxes(b.data), path[1:]...)
+	}
+	So(path[0], ShouldBeBlank)
+	return testBox{}
+}
+
+func TestRemux(t *testing.T) {
+	Convey("Remux", t, func() {
+		input := append(testSegment(900000, 10), testSegment(930000, 10)...)
+		var out bytes.Buffer
+		tags := Tags{Title: "Stream name", Artist: "Cauthon", Comment: "recorded"}
+		So(Remux(bytes.NewReader(input), &out, tags), ShouldBeNil)
+		boxes := readBoxes(out.Bytes())
+		So(boxTypes(boxes), ShouldResemble, []string{"ftyp", "moov", "mdat"})
+
+		moov := readBoxes(boxes[1].data)
+		So(boxTypes(moov), ShouldResemble, []string{"mvhd", "trak", "trak", "udta"})
+		stbl := findBox(readBoxes(moov[1].data), "mdia", "minf", "stbl")
+		stsz := findBox(readBoxes(stbl.data), "stsz")
+		So(binary.BigEndian.Uint32(stsz.data[8:]), ShouldEqual, 20)
+		firstSize := binary.BigEndian.Uint32(stsz.data[12:])
+		stco := findBox(readBoxes(stbl.data), "stco")
+		So(binary.BigEndian.Uint32(stco.data[4:]), ShouldBeGreaterThan, 0)
+		firstOffset := binary.BigEndian.Uint32(stco.data[8:])
+		So(binary.BigEndian.Uint32(out.Bytes()[firstOffset:]), ShouldEqual, firstSize-4)
+		stss := findBox(readBoxes(stbl.data), "stss")
+		So(binary.BigEndian.Uint32(stss.data[4:]), ShouldEqual, 2)
+
+		mdat := boxes[2]
+		So(len(out.Bytes())-len(mdat.data), ShouldEqual, firstOffset)
+
+		ilst := findBox(moov, "udta", "meta")
+		So(string(ilst.data), ShouldContainSubstring, "Stream name")
+		So(string(ilst.data), ShouldContainSubstring, "Cauthon")
+	})
+}
+
+func TestRemuxTimestampReset(t *testing.T) {
+	Convey("Remux keeps durations across a timestamp reset", t, func() {
+		input := append(testSegment(900000, 10), testSegment(100, 10)...)
+		var out bytes.Buffer
+		So(Remux(bytes.NewReader(input), &out, Tags{}), ShouldBeNil)
+		moov := readBoxes(readBoxes(out.Bytes())[1].data)
+		stbl := findBox(readBoxes(moov[1].data), "mdia", "minf", "stbl")
+		stts := findBox(readBoxes(stbl.data), "stts")
+		So(binary.BigEndian.Uint32(stts.data[4:]), ShouldEqual, 1)
+		So(binary.BigEndian.Uint32(stts.data[8:]), ShouldEqual, 20)
+		So(binary.BigEndian.Uint32(stts.data[12:]), ShouldEqual, 3000)
+	})
+}
+
+func TestLongDuration(t *testing.T) {
+	Convey("Durations of 2^32 ticks and more use version 1 boxes", t, func() {
+		const eightHours = 8 * 3600 * Timescale
+		track := &remuxTrack{
+			Track: &Track{ID: VideoTrackID, Handler: handlerVideo, Width: 1920, Height: 1080},
+			samples: []sampleEntry{
+				{dts: 0, size: 1, duration: eightHours, key: true},
+				{dts: eightHours, size: 1, duration: eightHours},
+			},
+			chunks: []int{2},
+		}
+		moov := readBoxes(movie([]*remuxTrack{track}, []chunkRun{{track: 0, size: 2}}, Tags{}, 0))
+		mvhd := findBox(readBoxes(moov[0].data), "mvhd")
+		So(mvhd.data[0], ShouldEqual, 0)
+		So(binary.BigEndian.Uint32(mvhd.data[16:]), ShouldEqual, 16*3600*movieTimescale)
+
+		trak := readBoxes(findBox(readBoxes(moov[0].data), "trak").data)
+		mdhd := findBox(trak, "mdia", "mdhd")
+		So(mdhd.data[0], ShouldEqual, 1)
+		So(binary.BigEndian.Uint32(mdhd.data[20:]), ShouldEqual, Timescale)
+		So(binary.BigEndian.Uint64(mdhd.data[24:]), ShouldEqual, 2*eightHours)
+		So(len(mdhd.data), ShouldEqual, 36)
+
+		tkhd := findBox(trak, "tkhd")
+		So(tkhd.data[0], ShouldEqual, 0)
+		So(binary.BigEndian.Uint32(tkhd.data[20:]), ShouldEqual, 16*3600*movieTimescale)
+		So(version(math.MaxUint32+1), ShouldEqual, 1)
+	})
+}
+
+func TestRemuxDamaged(t *testing.T) {
+	Convey("Remux skips damaged input", t, func() {
+		damaged := testSegment(930000, 10)
+		video := bytes.Index(damaged, []byte{0, 0, 1, 0xe0})
+		So(video, ShouldBeGreaterThan, 0)
+		damaged[video+2] = 2
+		audio := bytes.Index(damaged, []byte{0xff, 0xf1})
+		So(audio, ShouldBeGreaterThan, 0)
+		damaged[audio] = 0
+		input := append(testSegment(900000, 10), 0x00)
+		input = append(input, damaged...)
+
+		var out bytes.Buffer
+		So(Remux(bytes.NewReader(input), &out, Tags{}), ShouldBeNil)
+		moov := readBoxes(readBoxes(out.Bytes())[1].data)
+		count := func(trak testBox) uint32 {
+			stsz := findBox(readBoxes(trak.data), "mdia", "minf", "stbl", "stsz")
+			return binary.BigEndian.Uint32(stsz.data[8:])
+		}
+		So(count(moov[1]), ShouldEqual, 19)
+		So(count(moov[2]), ShouldEqual, 27)
+	})
+}
+
+func TestRetag(t *testing.T) {
+	Convey("Retag", t, func() {
+		var fragmented bytes.Buffer
+		f := NewFragmentWriter(&fragmented)
+		for _, start := range []uint64{900000, 930000} {
+			tracks, err := ReadTS(testSegment(start, 10))
+			So(err, ShouldBeNil)
+			_, err = f.WriteFragment(tracks)
+			So(err, ShouldBeNil)
+		}
+		original := readBoxes(fragmented.Bytes())
+
+		var once, twice bytes.Buffer
+		So(Retag(bytes.NewReader(fragmented.Bytes()), &once, Tags{Title: "first"}), ShouldBeNil)
+		So(Retag(bytes.NewReader(once.Bytes()), &twice, Tags{Title: "Stream name"}), ShouldBeNil)
+		boxes := readBoxes(twice.Bytes())
+		So(boxTypes(boxes), ShouldResemble, []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"})
+		So(boxTypes(readBoxes(boxes[1].data)), ShouldResemble, []string{"mvhd", "trak", "trak", "mvex", "udta"})
+		ilst := findBox(readBoxes(boxes[1].data), "udta", "meta")
+		So(string(ilst.data), ShouldContainSubstring, "Stream name")
+		So(string(ilst.data), ShouldNotContainSubstring, "first")
+		So(boxes[2:], ShouldResemble, original[2:])
+
+		So(Retag(bytes.NewReader(nil), &once, Tags{}), ShouldEqual, ErrNoInit)
+	})
+}
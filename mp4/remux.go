@@ -0,0 +1,409 @@
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/cydev/twitch/ts"
+)
+
+const maxChunkOffset = 1<<32 - 1
+
+var ErrInputChanged = errors.New("Input changed between passes")
+
+// Tags are stored in the iTunes-style metadata of the movie.
+type Tags struct {
+	Title     string
+	Artist    string
+	Date      string
+	Copyright string
+	Genre     string
+	Comment   string
+	Created   time.Time
+}
+
+type sampleEntry struct {
+	dts      uint64
+	offset   int32
+	size     uint32
+	duration uint32
+	key      bool
+}
+
+type remuxTrack struct {
+	*Track
+	samples []sampleEntry
+	chunks  []int
+	offsets []uint64
+}
+
+type chunkRun struct {
+	track int
+	size  uint64
+}
+
+// fillDurations sets each sample duration to the distance to the next
+// sample. Across a discontinuity or a timestamp reset the distance is
+// meaningless, so the previous duration is repeated instead.
+func (t *remuxTrack) fillDurations() {
+	for i := range t.samples {
+		if i+1 < len(t.samples) {
+			delta := (t.samples[i+1].dts - t.samples[i].dts) & ts.TimestampMask
+			if delta < maxTimestampJump {
+				t.samples[i].duration = uint32(delta)
+				continue
+			}
+		}
+		if i > 0 {
+			t.samples[i].duration = t.samples[i-1].duration
+		} else {
+			t.samples[i].duration = t.defaultDuration()
+		}
+	}
+}
+
+func (t *remuxTrack) duration() (d uint64) {
+	for _, s := range t.samples {
+		d += uint64(s.duration)
+	}
+	return d
+}
+
+func runLength(values []uint32) (runs [][2]uint32) {
+	for _, v := range values {
+		if n := len(runs); n > 0 && runs[n-1][1] == v {
+			runs[n-1][0]++
+			continue
+		}
+		runs = append(runs, [2]uint32{1, v})
+	}
+	return runs
+}
+
+func table(typ string, runs [][2]uint32) []byte {
+	b := make(buffer, 0, 4+8*len(runs))
+	b.u32(uint32(len(runs)))
+	for _, r := range runs {
+		b.u32(r[0]).u32(r[1])
+	}
+	return fullBox(typ, 0, 0, b)
+}
+
+func (t *remuxTrack) sampleTable(large bool) []byte {
+	var (
+		durations = make([]uint32, len(t.samples))
+		offsets   = make([]uint32, len(t.samples))
+		sizes     = make(buffer, 0, 12+4*len(t.samples))
+		sync      = make(buffer, 0, 4)
+		syncCount uint32
+		hasOffset bool
+	)
+	sizes.u32(0).u32(uint32(len(t.samples)))
+	for i, s := range t.samples {
+		durations[i] = s.duration
+		offsets[i] = uint32(s.offset)
+		hasOffset = hasOffset || s.offset != 0
+		sizes.u32(s.size)
+		if s.key {
+			sync.u32(uint32(i + 1))
+			syncCount++
+		}
+	}
+	boxes := [][]byte{stsd(t.Track), table("stts", runLength(durations))}
+	if hasOffset {
+		boxes = append(boxes, table("ctts", runLength(offsets)))
+	}
+	if t.IsVideo() {
+		count := make(buffer, 0, 4)
+		count.u32(syncCount)
+		boxes = append(boxes, fullBox("stss", 0, 0, count, sync))
+	}
+	var (
+		stsc      = make(buffer, 0)
+		stscCount uint32
+		last      = -1
+	)
+	for i, n := range t.chunks {
+		if n == last {
+			continue
+		}
+		stsc.u32(uint32(i + 1)).u32(uint32(n)).u32(1)
+		stscCount++
+		last = n
+	}
+	count := make(buffer, 0, 4)
+	count.u32(stscCount)
+	boxes = append(boxes, fullBox("stsc", 0, 0, count, stsc))
+	boxes = append(boxes, fullBox("stsz", 0, 0, sizes))
+	chunks := make(buffer, 0, 4+8*len(t.offsets))
+	chunks.u32(uint32(len(t.offsets)))
+	if large {
+		for _, o := range t.offsets {
+			chunks.u64(o)
+		}
+		boxes = append(boxes, fullBox("co64", 0, 0, chunks))
+	} else {
+		for _, o := range t.offsets {
+			chunks.u32(uint32(o))
+		}
+		boxes = append(boxes, fullBox("stco", 0, 0, chunks))
+	}
+	return box("stbl", boxes...)
+}
+
+func edts(start, first uint64, t *remuxTrack) []byte {
+	var (
+		b     = make(buffer, 0, 28)
+		count = uint32(1)
+		delay = (first - start) * movieTimescale / Timescale
+	)
+	if delay > 0 {
+		count++
+	}
+	b.u32(count)
+	if delay > 0 {
+		b.u32(uint32(delay)).u32(0xffffffff).u32(0x00010000)
+	}
+	b.u32(uint32(t.duration() * movieTimescale / Timescale))
+	b.u32(uint32(t.samples[0].offset)).u32(0x00010000)
+	return box("edts", fullBox("elst", 0, 0, b))
+}
+
+func item(name, value string) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+	b := make(buffer, 0, 8+len(value))
+	b.u32(1).u32(0).bytes([]byte(value))
+	return box(name, box("data", b))
+}
+
+func udta(tags Tags) []byte {
+	var items [][]byte
+	for _, i := range [][]byte{
+		item("\xa9nam", tags.Title),
+		item("\xa9ART", tags.Artist),
+		item("\xa9day", tags.Date),
+		item("cprt", tags.Copyright),
+		item("\xa9gen", tags.Genre),
+		item("\xa9cmt", tags.Comment),
+		item("\xa9too", "cydev/twitch"),
+	} {
+		if i != nil {
+			items = append(items, i)
+		}
+	}
+	handler := make(buffer, 0, 25)
+	handler.zero(4).bytes([]byte("mdirappl")).zero(9)
+	return box("udta", fullBox("meta", 0, 0,
+		fullBox("hdlr", 0, 0, handler),
+		box("ilst", items...),
+	))
+}
+
+func (t *remuxTrack) add(s Sample) {
+	t.samples = append(t.samples, sampleEntry{
+		dts:    s.DTS,
+		offset: s.Offset,
+		size:   uint32(len(s.Data)),
+		key:    s.Key,
+	})
+}
+
+func scan(r io.Reader) (tracks []*remuxTrack, runs []chunkRun, err error) {
+	var (
+		reader = newTSReader(bufio.NewReader(r))
+		byID   = make(map[uint32]int)
+	)
+	for {
+		t, sample, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		index, ok := byID[t.ID]
+		if !ok {
+			index = len(tracks)
+			byID[t.ID] = index
+			tracks = append(tracks, &remuxTrack{Track: t})
+		}
+		rt := tracks[index]
+		rt.add(sample)
+		if n := len(runs); n > 0 && runs[n-1].track == index {
+			runs[n-1].size += uint64(len(sample.Data))
+			rt.chunks[len(rt.chunks)-1]++
+			continue
+		}
+		runs = append(runs, chunkRun{track: index, size: uint64(len(sample.Data))})
+		rt.chunks = append(rt.chunks, 1)
+	}
+	if len(tracks) == 0 {
+		return nil, nil, ErrNoTracks
+	}
+	for _, t := range tracks {
+		t.fillDurations()
+	}
+	return tracks, runs, nil
+}
+
+func movie(tracks []*remuxTrack, runs []chunkRun, tags Tags, dataStart uint64) []byte {
+	var (
+		large    bool
+		offset   = dataStart
+		start    = tracks[0].samples[0].dts
+		duration uint64
+	)
+	for _, t := range tracks {
+		t.offsets = t.offsets[:0]
+		if d := t.samples[0].dts; (start-d)&ts.TimestampMask < maxTimestampJump {
+			start = d
+		}
+	}
+	for _, r := range runs {
+		tracks[r.track].offsets = append(tracks[r.track].offsets, offset)
+		offset += r.size
+	}
+	large = offset > maxChunkOffset
+	var traks [][]byte
+	for _, t := range tracks {
+		d := t.duration()
+		delay := (t.samples[0].dts - start) & ts.TimestampMask
+		if d+delay > duration {
+			duration = d + delay
+		}
+		traks = append(traks, box("trak",
+			tkhd(t.Track, tags.Created, d+delay),
+			edts(start, start+delay, t),
+			box("mdia", mdhd(tags.Created, d), hdlr(t.Track), minf(t.Track, t.sampleTable(large))),
+		))
+	}
+	boxes := append([][]byte{mvhd(tags.Created, duration, uint32(len(tracks)+1))}, traks...)
+	boxes = append(boxes, udta(tags))
+	return box("moov", boxes...)
+}
+
+// boxHeader returns the header of a box with size bytes of payload, with a
+// 64-bit size when it does not fit 32 bits.
+func boxHeader(typ string, size uint64) []byte {
+	b := make(buffer, 0, 16)
+	if size+8 <= maxChunkOffset {
+		b.u32(uint32(size + 8)).bytes([]byte(typ))
+		return b
+	}
+	b.u32(1).bytes([]byte(typ)).u64(size + 16)
+	return b
+}
+
+// Remux converts an MPEG-TS stream into a progressive MP4 with the moov
+// atom in front of the media data. The input is read twice: once to build
+// the sample tables and once to copy the samples.
+func Remux(input io.ReadSeeker, output io.Writer, tags Tags) error {
+	tracks, runs, err := scan(input)
+	if err != nil {
+		return err
+	}
+	var total uint64
+	for _, r := range runs {
+		total += r.size
+	}
+	var (
+		header = ftyp("isom", "isom", "iso2", "avc1", "mp41")
+		mdat   = boxHeader("mdat", total)
+		moov   = movie(tracks, runs, tags, 0)
+	)
+	for {
+		next := movie(tracks, runs, tags, uint64(len(header)+len(moov)+len(mdat)))
+		if len(next) == len(moov) {
+			moov = next
+			break
+		}
+		moov = next
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(output)
+	for _, b := range [][]byte{header, moov, mdat} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	var (
+		reader  = newTSReader(bufio.NewReader(input))
+		written uint64
+	)
+	for {
+		_, sample, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(sample.Data); err != nil {
+			return err
+		}
+		written += uint64(len(sample.Data))
+	}
+	if written != total {
+		return ErrInputChanged
+	}
+	return w.Flush()
+}
+
+// Retag copies a fragmented MP4 with the tags in the movie metadata,
+// replacing the tags it had. Fragments address their samples relative to
+// their moof, so a larger moov does not move anything they refer to.
+func Retag(input io.Reader, output io.Writer, tags Tags) error {
+	w := bufio.NewWriter(output)
+	for {
+		typ, size, err := readBoxHeader(input)
+		if err == io.EOF {
+			return ErrNoInit
+		}
+		if err != nil {
+			return err
+		}
+		if typ != "moov" {
+			if _, err := w.Write(boxHeader(typ, size)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, input, int64(size)); err != nil {
+				return err
+			}
+			continue
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(input, payload); err != nil {
+			return err
+		}
+		var boxes [][]byte
+		for len(payload) > 0 {
+			if len(payload) < 8 {
+				return ErrBadBox
+			}
+			n := int(binary.BigEndian.Uint32(payload))
+			if n < 8 || n > len(payload) {
+				return ErrBadBox
+			}
+			if string(payload[4:8]) != "udta" {
+				boxes = append(boxes, payload[:n])
+			}
+			payload = payload[n:]
+		}
+		boxes = append(boxes, udta(tags))
+		if _, err := w.Write(box("moov", boxes...)); err != nil {
+			return err
+		}
+		break
+	}
+	if _, err := io.Copy(w, input); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,217 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/cydev/twitch/ts"
+)
+
+const (
+	Timescale = ts.ClockRate
+
+	VideoTrackID = 1
+	AudioTrackID = 2
+
+	handlerVideo = "vide"
+	handlerAudio = "soun"
+
+	defaultVideoDuration = Timescale / 30
+)
+
+var ErrNoTracks = errors.New("No supported tracks")
+
+type Sample struct {
+	DTS      uint64
+	Offset   int32
+	Duration uint32
+	Key      bool
+	Data     []byte
+}
+
+// Track is an elementary stream with its decoder configuration. All tracks
+// use the 90kHz MPEG-TS clock as timescale.
+type Track struct {
+	ID      uint32
+	Handler string
+	Width   int
+	Height  int
+	Audio   AudioConfig
+	Config  []byte
+	Samples []Sample
+}
+
+func (t *Track) IsVideo() bool {
+	return t.Handler == handlerVideo
+}
+
+func (t *Track) defaultDuration() uint32 {
+	if t.IsVideo() {
+		return defaultVideoDuration
+	}
+	if rate := t.Audio.SampleRate(); rate > 0 {
+		return uint32(samplesPerFrame * Timescale / rate)
+	}
+	return 0
+}
+
+func (t *Track) fillDurations() {
+	for i := range t.Samples {
+		if i+1 < len(t.Samples) {
+			t.Samples[i].Duration = uint32((t.Samples[i+1].DTS - t.Samples[i].DTS) & ts.TimestampMask)
+			continue
+		}
+		if i > 0 {
+			t.Samples[i].Duration = t.Samples[i-1].Duration
+		} else {
+			t.Samples[i].Duration = t.defaultDuration()
+		}
+	}
+}
+
+func (t *Track) Duration() (d uint64) {
+	for _, s := range t.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+func (t *Track) size() (n int) {
+	for _, s := range t.Samples {
+		n += len(s.Data)
+	}
+	return n
+}
+
+type queuedSample struct {
+	track  *Track
+	sample Sample
+}
+
+// tsReader turns PES packets into samples, picking up the decoder
+// configuration of each track from the stream itself.
+type tsReader struct {
+	demuxer *ts.Demuxer
+	video   *Track
+	audio   *Track
+	queue   []queuedSample
+}
+
+func newTSReader(r io.Reader) *tsReader {
+	return &tsReader{
+		demuxer: ts.NewDemuxer(r),
+		video:   &Track{ID: VideoTrackID, Handler: handlerVideo},
+		audio:   &Track{ID: AudioTrackID, Handler: handlerAudio},
+	}
+}
+
+func (r *tsReader) readVideo(p ts.Packet) error {
+	nalus := SplitNALUs(p.Data)
+	if r.video.Config == nil {
+		var sps, pps []byte
+		for _, nalu := range nalus {
+			switch {
+			case len(nalu) == 0:
+			case nalu[0]&0x1f == naluSPS && sps == nil:
+				sps = nalu
+			case nalu[0]&0x1f == naluPPS && pps == nil:
+				pps = nalu
+			}
+		}
+		if sps == nil || pps == nil {
+			return nil
+		}
+		width, height, err := ParseSPS(sps)
+		if err != nil {
+			return err
+		}
+		r.video.Width, r.video.Height = width, height
+		r.video.Config = avcConfig(sps, pps)
+	}
+	sample, key := avcSample(nalus)
+	if len(sample) == 0 {
+		return nil
+	}
+	r.queue = append(r.queue, queuedSample{r.video, Sample{
+		DTS:    p.DTS,
+		Offset: int32((p.PTS - p.DTS) & ts.TimestampMask),
+		Key:    key,
+		Data:   sample,
+	}})
+	return nil
+}
+
+func (r *tsReader) readAudio(p ts.Packet) error {
+	// Frames after a damaged ADTS header are dropped.
+	frames, config, err := SplitADTS(p.Data)
+	if err != nil && err != ErrBadADTS {
+		return err
+	}
+	if r.audio.Config == nil && len(frames) > 0 {
+		r.audio.Audio = config
+		r.audio.Config = config.Bytes()
+	}
+	rate := r.audio.Audio.SampleRate()
+	if rate == 0 {
+		return nil
+	}
+	for i, frame := range frames {
+		r.queue = append(r.queue, queuedSample{r.audio, Sample{
+			DTS:  (p.PTS + uint64(i*samplesPerFrame*Timescale/rate)) & ts.TimestampMask,
+			Key:  true,
+			Data: frame,
+		}})
+	}
+	return nil
+}
+
+func (r *tsReader) next() (*Track, Sample, error) {
+	for len(r.queue) == 0 {
+		p, err := r.demuxer.Next()
+		if err == ts.ErrPES || err == ts.ErrShortData {
+			continue
+		}
+		if err != nil {
+			return nil, Sample{}, err
+		}
+		switch p.Type {
+		case ts.StreamH264:
+			err = r.readVideo(p)
+		case ts.StreamAAC:
+			err = r.readAudio(p)
+		}
+		if err != nil {
+			return nil, Sample{}, err
+		}
+	}
+	q := r.queue[0]
+	r.queue = r.queue[1:]
+	return q.track, q.sample, nil
+}
+
+// ReadTS demuxes an MPEG-TS segment into H.264 and AAC tracks.
+func ReadTS(data []byte) (tracks []*Track, err error) {
+	r := newTSReader(bytes.NewReader(data))
+	for {
+		t, sample, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Samples = append(t.Samples, sample)
+	}
+	for _, t := range []*Track{r.video, r.audio} {
+		if len(t.Samples) == 0 {
+			continue
+		}
+		t.fillDurations()
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return nil, ErrNoTracks
+	}
+	return tracks, nil
+}
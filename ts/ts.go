@@ -0,0 +1,285 @@
+package ts
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+
+	patPID = 0
+
+	TimestampMask = 1<<33 - 1
+	ClockRate     = 90000
+)
+
+type StreamType byte
+
+const (
+	StreamH264 StreamType = 0x1b
+	StreamAAC  StreamType = 0x0f
+)
+
+var (
+	ErrSync      = errors.New("Bad sync byte")
+	ErrShortData = errors.New("Short packet")
+	ErrPES       = errors.New("Bad PES header")
+)
+
+// Packet is a single reassembled PES packet of an elementary stream.
+type Packet struct {
+	PID          uint16
+	Type         StreamType
+	PTS          uint64
+	DTS          uint64
+	RandomAccess bool
+	Data         []byte
+}
+
+type pes struct {
+	typ    StreamType
+	random bool
+	data   []byte
+}
+
+// Demuxer reads a transport stream and reassembles PES packets of the
+// H.264 and AAC elementary streams, in the order they complete.
+type Demuxer struct {
+	r       io.Reader
+	buf     []byte
+	pmt     map[uint16]bool
+	streams map[uint16]StreamType
+	pending map[uint16]*pes
+	order   []uint16
+	packets []Packet
+	done    bool
+}
+
+// IsTS reports whether data looks like an MPEG transport stream.
+func IsTS(data []byte) bool {
+	if len(data) < PacketSize {
+		return false
+	}
+	if data[0] != SyncByte {
+		return false
+	}
+	return len(data) < 2*PacketSize || data[PacketSize] == SyncByte
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:       r,
+		buf:     make([]byte, PacketSize),
+		pmt:     make(map[uint16]bool),
+		streams: make(map[uint16]StreamType),
+		pending: make(map[uint16]*pes),
+	}
+}
+
+// read reads the next transport packet into d.buf. Bytes before a sync
+// byte are skipped, so a damaged packet only loses the data up to the next
+// one.
+func (d *Demuxer) read() error {
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		return err
+	}
+	for d.buf[0] != SyncByte {
+		i := bytes.IndexByte(d.buf, SyncByte)
+		if i < 0 {
+			i = len(d.buf)
+		}
+		n := copy(d.buf, d.buf[i:])
+		if _, err := io.ReadFull(d.r, d.buf[n:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Next returns the next complete PES packet or io.EOF at the end of stream.
+// A malformed PES packet is dropped and reported with ErrPES or
+// ErrShortData; Next can be called again to continue after it.
+func (d *Demuxer) Next() (p Packet, err error) {
+	for len(d.packets) == 0 {
+		if d.done {
+			return p, io.EOF
+		}
+		err := d.read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			d.done = true
+			var flushErr error
+			for _, pid := range d.order {
+				if err := d.flush(pid); err != nil && flushErr == nil {
+					flushErr = err
+				}
+			}
+			if flushErr != nil {
+				return p, flushErr
+			}
+			continue
+		}
+		if err != nil {
+			return p, err
+		}
+		if err := d.packet(d.buf); err != nil {
+			return p, err
+		}
+	}
+	p = d.packets[0]
+	d.packets = d.packets[1:]
+	return p, nil
+}
+
+// Demux splits transport stream data into PES packets.
+func Demux(data []byte) (packets []Packet, err error) {
+	d := NewDemuxer(bytes.NewReader(data))
+	for {
+		p, err := d.Next()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, p)
+	}
+}
+
+func (d *Demuxer) packet(p []byte) error {
+	if p[0] != SyncByte {
+		return ErrSync
+	}
+	var (
+		start   = p[1]&0x40 != 0
+		pid     = uint16(p[1]&0x1f)<<8 | uint16(p[2])
+		control = (p[3] >> 4) & 0x3
+		offset  = 4
+		random  bool
+	)
+	if control&0x2 != 0 {
+		length := int(p[4])
+		if length > 0 && offset+1 < len(p) {
+			random = p[5]&0x40 != 0
+		}
+		offset += 1 + length
+	}
+	if control&0x1 == 0 || offset >= len(p) {
+		return nil
+	}
+	payload := p[offset:]
+	switch {
+	case pid == patPID:
+		return d.pat(payload, start)
+	case d.pmt[pid]:
+		return d.pmtSection(payload, start)
+	}
+	typ, ok := d.streams[pid]
+	if !ok {
+		return nil
+	}
+	var err error
+	if start {
+		err = d.flush(pid)
+		d.pending[pid] = &pes{typ: typ, random: random}
+	}
+	if cur := d.pending[pid]; cur != nil {
+		cur.data = append(cur.data, payload...)
+	}
+	return err
+}
+
+func section(payload []byte, start bool) ([]byte, bool) {
+	if !start || len(payload) < 1 {
+		return nil, false
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, false
+	}
+	s := payload[1+pointer:]
+	length := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+length > len(s) || length < 9 {
+		return nil, false
+	}
+	return s[:3+length], true
+}
+
+func (d *Demuxer) pat(payload []byte, start bool) error {
+	s, ok := section(payload, start)
+	if !ok {
+		return nil
+	}
+	entries := s[8 : len(s)-4]
+	for i := 0; i+4 <= len(entries); i += 4 {
+		program := uint16(entries[i])<<8 | uint16(entries[i+1])
+		if program == 0 {
+			continue
+		}
+		d.pmt[uint16(entries[i+2]&0x1f)<<8|uint16(entries[i+3])] = true
+	}
+	return nil
+}
+
+func (d *Demuxer) pmtSection(payload []byte, start bool) error {
+	s, ok := section(payload, start)
+	if !ok || len(s) < 16 {
+		return nil
+	}
+	infoLength := int(s[10]&0x0f)<<8 | int(s[11])
+	if 12+infoLength > len(s)-4 {
+		return nil
+	}
+	entries := s[12+infoLength : len(s)-4]
+	for i := 0; i+5 <= len(entries); {
+		typ := StreamType(entries[i])
+		pid := uint16(entries[i+1]&0x1f)<<8 | uint16(entries[i+2])
+		esLength := int(entries[i+3]&0x0f)<<8 | int(entries[i+4])
+		if _, known := d.streams[pid]; !known && (typ == StreamH264 || typ == StreamAAC) {
+			d.streams[pid] = typ
+			d.order = append(d.order, pid)
+		}
+		i += 5 + esLength
+	}
+	return nil
+}
+
+func timestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 |
+		uint64(b[1])<<22 |
+		uint64(b[2]>>1)<<15 |
+		uint64(b[3])<<7 |
+		uint64(b[4]>>1)
+}
+
+func (d *Demuxer) flush(pid uint16) error {
+	cur := d.pending[pid]
+	delete(d.pending, pid)
+	if cur == nil {
+		return nil
+	}
+	b := cur.data
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return ErrPES
+	}
+	var (
+		flags        = b[7] >> 6
+		headerLength = int(b[8])
+		p            = Packet{PID: pid, Type: cur.typ, RandomAccess: cur.random}
+	)
+	if 9+headerLength > len(b) {
+		return ErrShortData
+	}
+	if flags&0x2 != 0 && headerLength >= 5 {
+		p.PTS = timestamp(b[9:14])
+		p.DTS = p.PTS
+	}
+	if flags == 0x3 && headerLength >= 10 {
+		p.DTS = timestamp(b[14:19])
+	}
+	p.Data = b[9+headerLength:]
+	d.packets = append(d.packets, p)
+	return nil
+}
@@ -0,0 +1,175 @@
+package ts
+
+import (
+	"io"
+)
+
+const (
+	pmtPID   = 0x1000
+	VideoPID = 0x100
+	AudioPID = 0x101
+)
+
+// Writer produces a minimal transport stream with one program carrying
+// an H.264 and an AAC elementary stream.
+type Writer struct {
+	w          io.Writer
+	continuity map[uint16]byte
+	tables     bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, continuity: make(map[uint16]byte)}
+}
+
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func withCRC(s []byte) []byte {
+	crc := crc32(s)
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func (w *Writer) writeSection(pid uint16, s []byte) error {
+	payload := append([]byte{0}, s...)
+	return w.writePackets(pid, payload, true, nil)
+}
+
+func (w *Writer) writeTables() error {
+	pat := withCRC([]byte{
+		0x00, 0xb0, 13,
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xe0 | pmtPID>>8, pmtPID & 0xff,
+	})
+	if err := w.writeSection(patPID, pat); err != nil {
+		return err
+	}
+	pmt := withCRC([]byte{
+		0x02, 0xb0, 23,
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | VideoPID>>8, VideoPID & 0xff,
+		0xf0, 0x00,
+		byte(StreamH264), 0xe0 | VideoPID>>8, VideoPID & 0xff, 0xf0, 0x00,
+		byte(StreamAAC), 0xe0 | AudioPID>>8, AudioPID & 0xff, 0xf0, 0x00,
+	})
+	return w.writeSection(pmtPID, pmt)
+}
+
+func putTimestamp(b []byte, marker byte, t uint64) {
+	b[0] = marker<<4 | byte(t>>29)&0x0e | 1
+	b[1] = byte(t >> 22)
+	b[2] = byte(t>>14) | 1
+	b[3] = byte(t >> 7)
+	b[4] = byte(t<<1) | 1
+}
+
+func (w *Writer) writePackets(pid uint16, payload []byte, start bool, adaptation []byte) error {
+	for len(payload) > 0 {
+		var (
+			p        = make([]byte, PacketSize)
+			adapt    = append([]byte(nil), adaptation...)
+			hasAdapt = len(adapt) > 0
+			space    = PacketSize - 4
+		)
+		if hasAdapt {
+			space -= 1 + len(adapt)
+		}
+		n := len(payload)
+		if n > space {
+			n = space
+		}
+		if n < space {
+			if !hasAdapt {
+				hasAdapt = true
+				space--
+			}
+			pad := space - n
+			if len(adapt) == 0 && pad > 0 {
+				adapt = append(adapt, 0)
+				pad--
+			}
+			for ; pad > 0; pad-- {
+				adapt = append(adapt, 0xff)
+			}
+		}
+		p[0] = SyncByte
+		p[1] = byte(pid>>8) & 0x1f
+		if start {
+			p[1] |= 0x40
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | w.continuity[pid]&0x0f
+		offset := 4
+		if hasAdapt {
+			p[3] |= 0x20
+			p[4] = byte(len(adapt))
+			copy(p[5:], adapt)
+			offset = 5 + len(adapt)
+		}
+		w.continuity[pid]++
+		copy(p[offset:], payload[:n])
+		if _, err := w.w.Write(p); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		start = false
+		adaptation = nil
+	}
+	return nil
+}
+
+// WritePacket writes a single PES packet, emitting PAT and PMT first when
+// needed. Random access packets carry a PCR and repeat the tables.
+func (w *Writer) WritePacket(p Packet) error {
+	if !w.tables || p.RandomAccess {
+		if err := w.writeTables(); err != nil {
+			return err
+		}
+		w.tables = true
+	}
+	streamID := byte(0xe0)
+	pid := uint16(VideoPID)
+	if p.Type == StreamAAC {
+		streamID = 0xc0
+		pid = AudioPID
+	}
+	if p.PID != 0 {
+		pid = p.PID
+	}
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5, 0, 0, 0, 0, 0}
+	if p.DTS != p.PTS {
+		header[7] = 0xc0
+		header[8] = 10
+		header = append(header, 0, 0, 0, 0, 0)
+		putTimestamp(header[9:14], 3, p.PTS)
+		putTimestamp(header[14:19], 1, p.DTS)
+	} else {
+		putTimestamp(header[9:14], 2, p.PTS)
+	}
+	if length := len(header) - 6 + len(p.Data); length < 0x10000 && p.Type == StreamAAC {
+		header[4] = byte(length >> 8)
+		header[5] = byte(length)
+	}
+	var adaptation []byte
+	if p.RandomAccess {
+		pcr := p.DTS
+		adaptation = []byte{
+			0x50,
+			byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1),
+			byte(pcr<<7) | 0x7e, 0,
+		}
+	}
+	return w.writePackets(pid, append(header, p.Data...), true, adaptation)
+}
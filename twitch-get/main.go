@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"net"
 	"net/http"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cydev/twitch/downloader"
+	"github.com/cydev/twitch/telegram"
 )
 
 const (
@@ -17,6 +26,73 @@ const (
 	defaultHTTPHeadersTimeout = defaultRequestTimeout
 )
 
+var (
+	configPath    string
+	telegramToken string
+	chatRoom      int
+	webhookURL    string
+	webhookSecret string
+	webhookQueue  string
+	discordURL    string
+	slackURL      string
+	smtpAddr      string
+	smtpUser      string
+	smtpPassword  string
+	mailFrom      string
+	mailTo        string
+	language      string
+)
+
+func init() {
+	flag.StringVar(&configPath, "config", "", "Path to JSON config file")
+	flag.IntVar(&chatRoom, "chat", 1863832, "Telegram chat id")
+	flag.StringVar(&language, "lang", "", "Language of notifications, en or ru (default from config or ru)")
+	flag.StringVar(&telegramToken, "telegram-token", "", "Token for telegram bot, notifications are only logged without it")
+	flag.StringVar(&webhookURL, "webhook-url", "", "URL to post signed JSON events to")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "HMAC secret for webhook signatures")
+	flag.StringVar(&webhookQueue, "webhook-queue", "", "Directory for undelivered webhook events (default webhook-queue in -dir)")
+	flag.StringVar(&discordURL, "discord-webhook", "", "Discord incoming webhook URL")
+	flag.StringVar(&slackURL, "slack-webhook", "", "Slack incoming webhook URL")
+	flag.StringVar(&smtpAddr, "smtp-addr", "", "SMTP server host:port for the daily e-mail digest")
+	flag.StringVar(&smtpUser, "smtp-user", "", "SMTP user, no authentication without it")
+	flag.StringVar(&smtpPassword, "smtp-password", "", "SMTP password")
+	flag.StringVar(&mailFrom, "mail-from", "", "Sender of digest e-mails")
+	flag.StringVar(&mailTo, "mail-to", "", "Comma separated digest recipients")
+}
+
+type config struct {
+	Channels []string          `json:"channels"`
+	Language string            `json:"language"`
+	Messages map[string]string `json:"messages"`
+}
+
+// setMessages selects the notification language and applies the message
+// templates overridden in cfg.
+func setMessages(cfg config) {
+	lang := language
+	if len(lang) == 0 {
+		lang = cfg.Language
+	}
+	if len(lang) == 0 {
+		lang = "ru"
+	}
+	m, err := downloader.NewMessages(lang, cfg.Messages)
+	if err != nil {
+		log.Fatalln("bad messages config:", err)
+	}
+	downloader.DefaultMessages = m
+}
+
+func readConfig(name string) (cfg config, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	return cfg, decoder.Decode(&cfg)
+}
+
 func getDefaultHTTPClient() *http.Client {
 	client := &http.Client{
 		Timeout: defaultRequestTimeout,
@@ -33,14 +109,184 @@ func getDefaultHTTPClient() *http.Client {
 	return client
 }
 
+// shutdownContext is cancelled on the first SIGINT or SIGTERM. A second
+// signal kills the process.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println("got", sig, "finishing recordings")
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+func newNotifier() downloader.Notifier {
+	if len(telegramToken) == 0 {
+		return downloader.LogNotifier{}
+	}
+	return telegram.New(telegramToken, chatRoom)
+}
+
+type flusher interface {
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// withChats adds the configured Discord and Slack webhooks to n. The
+// returned function waits for their queued messages, then closes them.
+func withChats(client *http.Client, n downloader.Notifier) (downloader.Notifier, func()) {
+	notifiers := []downloader.Notifier{n}
+	var chats []flusher
+	if len(discordURL) > 0 {
+		d, err := downloader.NewDiscord(client, discordURL)
+		if err != nil {
+			log.Fatalln("bad discord webhook:", err)
+		}
+		notifiers = append(notifiers, d)
+		chats = append(chats, d)
+	}
+	if len(slackURL) > 0 {
+		s, err := downloader.NewSlack(client, slackURL)
+		if err != nil {
+			log.Fatalln("bad slack webhook:", err)
+		}
+		notifiers = append(notifiers, s)
+		chats = append(chats, s)
+	}
+	flush := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+		defer cancel()
+		for _, c := range chats {
+			if err := c.Flush(ctx); err != nil {
+				log.Println("chat messages left in queue:", err)
+			}
+			c.Close()
+		}
+	}
+	if len(notifiers) == 1 {
+		return n, flush
+	}
+	return downloader.MultiNotifier(notifiers...), flush
+}
+
+// startWebhook adds the webhook to n and delivers its queue until ctx is
+// done. The returned function flushes what is left.
+func startWebhook(ctx context.Context, client *http.Client, n downloader.Notifier) (downloader.Notifier, func()) {
+	if len(webhookURL) == 0 {
+		return n, func() {}
+	}
+	hook, err := downloader.NewWebhook(client, webhookURL, webhookSecret, webhookQueue)
+	if err != nil {
+		log.Fatalln("unable to create webhook queue:", err)
+	}
+	go hook.Run(ctx)
+	return downloader.MultiNotifier(n, hook), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+		defer cancel()
+		if err := hook.Flush(ctx); err != nil {
+			log.Println("webhook events left in queue:", err)
+		}
+	}
+}
+
+// startMail adds the e-mail digest to n and mails it every midnight until
+// ctx is done. The returned function mails what is left.
+func startMail(ctx context.Context, n downloader.Notifier) (downloader.Notifier, func()) {
+	if len(smtpAddr) == 0 {
+		return n, func() {}
+	}
+	host, _, err := net.SplitHostPort(smtpAddr)
+	if err != nil {
+		log.Fatalln("bad smtp address:", err)
+	}
+	var to []string
+	for _, rcpt := range strings.Split(mailTo, ",") {
+		if rcpt = strings.TrimSpace(rcpt); len(rcpt) > 0 {
+			to = append(to, rcpt)
+		}
+	}
+	if len(to) == 0 {
+		log.Fatalln("no -mail-to recipients for -smtp-addr")
+	}
+	var auth smtp.Auth
+	if len(smtpUser) > 0 {
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, host)
+	}
+	m := downloader.NewMail(smtpAddr, auth, mailFrom, to)
+	go m.Run(ctx)
+	return downloader.MultiNotifier(n, m), func() {
+		m.Wait()
+		if err := m.SendDigest(time.Now()); err != nil {
+			log.Println("digest mail failed:", err)
+		}
+	}
+}
+
+// handleStatus answers the telegram /status command with the supervisor
+// report.
+func handleStatus(n downloader.Notifier, s *downloader.Supervisor) {
+	bot, ok := n.(telegram.Notifier)
+	if !ok {
+		return
+	}
+	bot.Handle("/status", func(event string, args []string, chat int) {
+		log.Println("got status request", event, args, chat)
+		if err := bot.Notify(s.Report()); err != nil {
+			log.Println("notification failed:", err)
+		}
+	})
+}
+
 func main() {
 	flag.Parse()
 	client := getDefaultHTTPClient()
-	if flag.NArg() < 1 {
+	var cfg config
+	if len(configPath) > 0 {
+		var err error
+		if cfg, err = readConfig(configPath); err != nil {
+			log.Fatalln("unable to read config:", err)
+		}
+	}
+	setMessages(cfg)
+	if flag.Arg(0) == "vod" {
+		if flag.NArg() != 2 {
+			log.Fatalln("usage: twitch-get vod <id>")
+		}
+		events, flushChats := withChats(client, newNotifier())
+		s := downloader.NewSupervisor(client, events)
+		err := s.DownloadVODContext(shutdownContext(), flag.Arg(1))
+		flushChats()
+		if errors.Is(err, context.Canceled) {
+			log.Println("vod download stopped")
+			return
+		}
+		if err != nil {
+			log.Fatalln("vod download failed:", err)
+		}
+		return
+	}
+	channels := append(flag.Args(), cfg.Channels...)
+	if len(channels) < 1 {
 		log.Fatalln("no stream name specified")
 	}
-	streamName := flag.Arg(0)
-	log.Println("waiting for stream", streamName)
-	d := downloader.New(streamName, client)
-	d.Start()
+	ctx := shutdownContext()
+	notifier := newNotifier()
+	events, flushChats := withChats(client, notifier)
+	events, sendDigest := startMail(ctx, events)
+	events, flush := startWebhook(ctx, client, events)
+	s := downloader.NewSupervisor(client, events)
+	handleStatus(notifier, s)
+	for _, name := range channels {
+		log.Println("waiting for stream", name)
+		s.Add(name)
+	}
+	s.StartContext(ctx)
+	flush()
+	flushChats()
+	sendDigest()
+	log.Println("stopped")
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -13,8 +16,12 @@ import (
 
 	torrent "github.com/anacrolix/torrent/metainfo"
 	"github.com/cydev/twitch/downloader"
+	"github.com/cydev/twitch/mp4"
+	"github.com/cydev/twitch/ts"
 )
 
+var ErrUnknownFormat = errors.New("Recording is neither MPEG-TS nor MP4, use -transcode")
+
 type Video struct {
 	Meta           downloader.Metadata
 	Filename       string
@@ -26,6 +33,8 @@ func (_ Video) metaArg(k, v string) string {
 }
 
 var (
+	transcode string
+
 	builtinAnnounceList = [][]string{
 		{"udp://tracker.openbittorrent.com:80"},
 		{"udp://tracker.leechers-paradise.org:6969"},
@@ -70,11 +79,33 @@ func (v Video) createTorrent() error {
 	}
 }
 
+func init() {
+	flag.StringVar(&transcode, "transcode", "", "ffmpeg encoding arguments, e.g. \"-c:v libx264 -crf 23 -c:a aac\"")
+}
+
+func (v Video) copyright() string {
+	return fmt.Sprintf("Copyright %d %s", v.Meta.Date.Year(), v.Meta.Author)
+}
+
+func (v Video) tags() mp4.Tags {
+	return mp4.Tags{
+		Title:     v.Meta.Title,
+		Artist:    v.Meta.Author,
+		Date:      v.Meta.Date.Format(time.RFC3339),
+		Copyright: v.copyright(),
+		Genre:     v.Meta.Game,
+		Created:   v.Meta.Date,
+	}
+}
+
 func (v Video) getMetadataArgs() (args []string) {
 	args = append(args, "-metadata", v.metaArg("title", v.Meta.Title))
 	args = append(args, "-metadata", v.metaArg("author", v.Meta.Author))
 	args = append(args, "-metadata", v.metaArg("date", v.Meta.Date.Format(time.RFC3339)))
-	args = append(args, "-metadata", v.metaArg("copyright", fmt.Sprintf("Copyright %d %s", v.Meta.Date.Year(), v.Meta.Author)))
+	args = append(args, "-metadata", v.metaArg("copyright", v.copyright()))
+	if len(v.Meta.Game) > 0 {
+		args = append(args, "-metadata", v.metaArg("genre", v.Meta.Game))
+	}
 
 	return args
 }
@@ -90,10 +121,11 @@ func (v Video) outputFilename() string {
 }
 
 func (v Video) command() (cmd *exec.Cmd) {
-	args := []string{
-		"-i", v.Filename,
-		"-c", "copy",
-		"-bsf:a", "aac_adtstoasc",
+	args := []string{"-i", v.Filename}
+	if len(transcode) > 0 {
+		args = append(args, strings.Fields(transcode)...)
+	} else {
+		args = append(args, "-c", "copy", "-bsf:a", "aac_adtstoasc")
 	}
 	args = append(args, v.getMetadataArgs()...)
 	args = append(args, "-movflags", "faststart", v.OutputFilename)
@@ -104,8 +136,105 @@ func (v Video) command() (cmd *exec.Cmd) {
 	return cmd
 }
 
+func isTS(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, 2*ts.PacketSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return ts.IsTS(header[:n]), nil
+}
+
+// isMP4 reports whether the file starts with an ftyp box, as fragmented MP4
+// recordings do.
+func isMP4(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(header[4:]) == "ftyp", nil
+}
+
+// copyFile copies a fragmented MP4 recording, which is already playable,
+// to the output file with the metadata tags added.
+func (v Video) copyFile() error {
+	input, err := os.Open(v.Filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.Create(v.OutputFilename)
+	if err != nil {
+		return err
+	}
+	if err := mp4.Retag(input, output, v.tags()); err != nil {
+		output.Close()
+		os.Remove(v.OutputFilename)
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+func (v Video) remux() error {
+	input, err := os.Open(v.Filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.Create(v.OutputFilename)
+	if err != nil {
+		return err
+	}
+	if err := mp4.Remux(input, output, v.tags()); err != nil {
+		output.Close()
+		os.Remove(v.OutputFilename)
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
 func (v *Video) Prepare() error {
 	v.OutputFilename = v.outputFilename()
+	if len(transcode) == 0 {
+		plain, err := isTS(v.Filename)
+		if err != nil {
+			return err
+		}
+		if plain {
+			log.Println("remuxing", v.Filename, "to", v.OutputFilename)
+			return v.remux()
+		}
+		fragmented, err := isMP4(v.Filename)
+		if err != nil {
+			return err
+		}
+		if !fragmented {
+			return ErrUnknownFormat
+		}
+		log.Println("copying", v.Filename, "to", v.OutputFilename)
+		return v.copyFile()
+	}
 	cmd := v.command()
 	fmt.Print("exec", cmd.Args)
 	return cmd.Run()
@@ -140,10 +269,11 @@ func prepare(filename string) error {
 
 func main() {
 	fmt.Println("cydev/twitch-prepare")
-	if len(os.Args) != 2 {
+	flag.Parse()
+	if flag.NArg() != 1 {
 		return
 	}
-	name := os.Args[1]
+	name := flag.Arg(0)
 	stat, err := os.Stat(name)
 	if err != nil {
 		log.Fatal(err)
@@ -164,7 +294,7 @@ func main() {
 		if strings.Contains(f.Name(), "-stream.mp4") {
 			continue
 		}
-		if !strings.HasSuffix(f.Name(), "mp4") {
+		if !strings.HasSuffix(f.Name(), ".mp4") && !strings.HasSuffix(f.Name(), ".ts") {
 			continue
 		}
 		fmt.Println(f.Name())
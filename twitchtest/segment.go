@@ -0,0 +1,154 @@
+package twitchtest
+
+import (
+	"bytes"
+
+	"github.com/cydev/twitch/ts"
+)
+
+const (
+	frameTicks = ts.ClockRate / 30
+	audioTicks = 1024 * ts.ClockRate / 44100
+)
+
+type bitWriter struct {
+	data []byte
+	n    uint
+}
+
+func (w *bitWriter) bit(v uint) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= byte(v&1) << (7 - w.n%8)
+	w.n++
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(v >> uint(i))
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+func escapeRBSP(data []byte) (out []byte) {
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// SPS returns a baseline profile sequence parameter set NAL unit.
+func SPS(width, height int) []byte {
+	w := &bitWriter{}
+	w.bits(66, 8)
+	w.bits(0, 8)
+	w.bits(31, 8)
+	w.ue(0)
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bit(0)
+	mbsWidth, mbsHeight := (width+15)/16, (height+15)/16
+	w.ue(uint(mbsWidth - 1))
+	w.ue(uint(mbsHeight - 1))
+	w.bit(1)
+	w.bit(1)
+	if cropX, cropY := mbsWidth*16-width, mbsHeight*16-height; cropX > 0 || cropY > 0 {
+		w.bit(1)
+		w.ue(0)
+		w.ue(uint(cropX / 2))
+		w.ue(0)
+		w.ue(uint(cropY / 2))
+	} else {
+		w.bit(0)
+	}
+	w.bit(0)
+	w.bit(1)
+	return append([]byte{0x67}, escapeRBSP(w.data)...)
+}
+
+func adts(payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte{
+		0xff, 0xf1,
+		1<<6 | 4<<2 | 0,
+		2<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length<<5) | 0x1f,
+		0xfc,
+	}
+	return append(header, payload...)
+}
+
+// Segment generates an MPEG-TS segment starting at the start timestamp with
+// 30 fps H.264 video of the given size and 44.1 kHz AAC audio. Zero width
+// or height produces an audio only segment.
+func Segment(start, duration uint64, width, height int) []byte {
+	var (
+		out bytes.Buffer
+		w   = ts.NewWriter(&out)
+		pps = []byte{0x68, 0xce, 0x38, 0x80}
+		err error
+	)
+	write := func(p ts.Packet) {
+		if err == nil {
+			err = w.WritePacket(p)
+		}
+	}
+	if width > 0 && height > 0 {
+		sps := SPS(width, height)
+		for i := uint64(0); i*frameTicks < duration; i++ {
+			dts := start + i*frameTicks
+			au := []byte{0, 0, 0, 1, 0x09, 0xf0}
+			if i == 0 {
+				au = append(au, 0, 0, 0, 1)
+				au = append(au, sps...)
+				au = append(au, 0, 0, 0, 1)
+				au = append(au, pps...)
+				au = append(au, 0, 0, 1, 0x65)
+			} else {
+				au = append(au, 0, 0, 1, 0x41)
+			}
+			au = append(au, bytes.Repeat([]byte{byte(i)}, 64)...)
+			write(ts.Packet{
+				Type:         ts.StreamH264,
+				PTS:          (dts + 2*frameTicks) & ts.TimestampMask,
+				DTS:          dts & ts.TimestampMask,
+				RandomAccess: i == 0,
+				Data:         au,
+			})
+		}
+	}
+	for i := uint64(0); i*audioTicks < duration; i += 3 {
+		var frames []byte
+		for j := 0; j < 3; j++ {
+			frames = append(frames, adts(bytes.Repeat([]byte{0x21}, 16))...)
+		}
+		pts := (start + i*audioTicks) & ts.TimestampMask
+		write(ts.Packet{Type: ts.StreamAAC, PTS: pts, DTS: pts, Data: frames})
+	}
+	if err != nil {
+		panic(err)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,416 @@
+// Package twitchtest provides an in-process fake Twitch for tests. It serves
+// the access token, kraken and Helix streams endpoints and Usher master and
+// media playlists with generated MPEG-TS segments. Tests script broadcasts
+// through Channel.
+package twitchtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cydev/twitch/api"
+	"github.com/cydev/twitch/ts"
+)
+
+const (
+	DefaultSegmentDuration = 2 * time.Second
+	DefaultWindow          = 6
+)
+
+// Variant is a rendition listed in the master playlist. Variants without
+// a resolution are audio only.
+type Variant struct {
+	ID        string
+	Name      string
+	Width     int
+	Height    int
+	FrameRate float64
+	Bandwidth uint32
+}
+
+var DefaultVariants = []Variant{
+	{ID: "chunked", Name: "1080p60 (source)", Width: 1920, Height: 1080, FrameRate: 60, Bandwidth: 6000000},
+	{ID: "720p60", Name: "720p60", Width: 1280, Height: 720, FrameRate: 60, Bandwidth: 3000000},
+	{ID: "480p30", Name: "480p", Width: 852, Height: 480, FrameRate: 30, Bandwidth: 1400000},
+	{ID: "audio_only", Name: "audio_only", Bandwidth: 160000},
+}
+
+type Server struct {
+	*httptest.Server
+	SegmentDuration time.Duration
+	Window          int
+
+	mu       sync.Mutex
+	channels map[string]*Channel
+}
+
+type liveSegment struct {
+	seq           uint64
+	discontinuity bool
+	dropped       bool
+}
+
+// Channel is a scripted channel. A new channel is offline until GoLive.
+type Channel struct {
+	server *Server
+	name   string
+
+	live             bool
+	id               int64
+	title            string
+	game             string
+	started          time.Time
+	variants         []Variant
+	next             uint64
+	segments         []liveSegment
+	discontinuity    bool
+	playlistRequests int
+	fetched          map[uint64]int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		SegmentDuration: DefaultSegmentDuration,
+		Window:          DefaultWindow,
+		channels:        make(map[string]*Channel),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/channels/", s.token)
+	mux.HandleFunc("/kraken/streams/", s.krakenStream)
+	mux.HandleFunc("/helix/streams", s.helixStreams)
+	mux.HandleFunc("/api/channel/hls/", s.master)
+	mux.HandleFunc("/hls/", s.media)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Channel returns the channel with the given login, creating it offline.
+func (s *Server) Channel(name string) *Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = strings.ToLower(name)
+	c, ok := s.channels[name]
+	if !ok {
+		c = &Channel{server: s, name: name, fetched: make(map[uint64]int)}
+		s.channels[name] = c
+	}
+	return c
+}
+
+func (s *Server) lookup(name string) *Channel {
+	return s.channels[strings.ToLower(name)]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"error":   "Not Found",
+		"status":  http.StatusNotFound,
+		"message": message,
+	})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/channels/"), "/")
+	if len(parts) != 2 || parts[1] != "access_token.json" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(parts[0])
+	if c == nil {
+		notFound(w, fmt.Sprintf("Channel '%s' does not exist", parts[0]))
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"channel": c.name})
+	writeJSON(w, http.StatusOK, api.Token{Body: string(body), Sig: c.sig()})
+}
+
+func (c *Channel) sig() string {
+	return "sig-" + c.name
+}
+
+func (c *Channel) stream() *api.Stream {
+	if !c.live {
+		return nil
+	}
+	stream := &api.Stream{ID: c.id, Game: c.game, CreatedAt: c.started}
+	stream.Data.Name = c.name
+	stream.Data.Status = c.title
+	return stream
+}
+
+func (s *Server) krakenStream(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/kraken/streams/"), ".json")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(name)
+	if c == nil {
+		notFound(w, fmt.Sprintf("Channel '%s' does not exist", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, api.Channel{Stream: c.stream()})
+}
+
+func (s *Server) helixStreams(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streams := []api.HelixStream{}
+	for _, login := range r.URL.Query()["user_login"] {
+		c := s.lookup(login)
+		if c == nil || !c.live {
+			continue
+		}
+		streams = append(streams, api.HelixStream{
+			ID:        strconv.FormatInt(c.id, 10),
+			UserLogin: c.name,
+			UserName:  c.name,
+			GameName:  c.game,
+			Type:      "live",
+			Title:     c.title,
+			StartedAt: c.started,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":       streams,
+		"pagination": api.Pagination{},
+	})
+}
+
+func (s *Server) master(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/channel/hls/"), ".m3u8")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(name)
+	if c == nil || !c.live {
+		notFound(w, "Can not find channel")
+		return
+	}
+	if r.URL.Query().Get("sig") != c.sig() {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"error":   "Forbidden",
+			"status":  http.StatusForbidden,
+			"message": "Bad signature",
+		})
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	for _, v := range c.variants {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID=%q,NAME=%q,AUTOSELECT=YES,DEFAULT=YES\n", v.ID, v.Name)
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+		if v.Width > 0 && v.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d,CODECS=\"avc1.42001f,mp4a.40.2\"", v.Width, v.Height)
+		} else {
+			b.WriteString(",CODECS=\"mp4a.40.2\"")
+		}
+		fmt.Fprintf(&b, ",VIDEO=%q", v.ID)
+		if v.FrameRate > 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", v.FrameRate)
+		}
+		fmt.Fprintf(&b, "\n%s/hls/%s/%s/index.m3u8\n", s.URL, c.name, v.ID)
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(b.Bytes())
+}
+
+func (c *Channel) variant(id string) (Variant, bool) {
+	for _, v := range c.variants {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+func (c *Channel) window() []liveSegment {
+	if window := c.server.Window; window > 0 && len(c.segments) > window {
+		return c.segments[len(c.segments)-window:]
+	}
+	return c.segments
+}
+
+func (s *Server) media(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.lookup(parts[0])
+	if c == nil || !c.live {
+		notFound(w, "Broadcast is over")
+		return
+	}
+	v, ok := c.variant(parts[1])
+	if !ok {
+		notFound(w, "Unknown variant")
+		return
+	}
+	if parts[2] == "index.m3u8" {
+		c.playlistRequests++
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(c.playlist())
+		return
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(parts[2], ".ts"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, segment := range c.window() {
+		if segment.seq != seq {
+			continue
+		}
+		c.fetched[seq]++
+		if segment.dropped {
+			notFound(w, "Segment unavailable")
+			return
+		}
+		duration := uint64(s.SegmentDuration.Seconds() * ts.ClockRate)
+		w.Header().Set("Content-Type", "video/MP2T")
+		w.Write(Segment(seq*duration, duration, v.Width, v.Height))
+		return
+	}
+	notFound(w, "Segment expired")
+}
+
+func (c *Channel) playlist() []byte {
+	var (
+		b        bytes.Buffer
+		window   = c.window()
+		duration = c.server.SegmentDuration.Seconds()
+		first    = c.next
+	)
+	if len(window) > 0 {
+		first = window[0].seq
+	}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%g\n", duration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for _, segment := range window {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,live\n%d.ts\n", duration, segment.seq)
+	}
+	return b.Bytes()
+}
+
+// GoLive starts a broadcast with the default variants and an empty playlist.
+func (c *Channel) GoLive(id int64, title, game string) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.live = true
+	c.id = id
+	c.title = title
+	c.game = game
+	c.started = time.Now().UTC().Truncate(time.Second)
+	c.variants = append([]Variant(nil), DefaultVariants...)
+	c.segments = nil
+}
+
+// End finishes the broadcast: the channel is reported offline and its
+// playlists are gone.
+func (c *Channel) End() {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.live = false
+}
+
+func (c *Channel) appendSegments(n int, dropped bool) {
+	for i := 0; i < n; i++ {
+		c.segments = append(c.segments, liveSegment{
+			seq:           c.next,
+			discontinuity: c.discontinuity,
+			dropped:       dropped,
+		})
+		c.discontinuity = false
+		c.next++
+	}
+}
+
+// Append adds n segments to the live playlist.
+func (c *Channel) Append(n int) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.appendSegments(n, false)
+}
+
+// Drop adds n segments that are listed in the playlist but fail to download.
+func (c *Channel) Drop(n int) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.appendSegments(n, true)
+}
+
+// Restore makes a dropped segment downloadable again, as if it failed only
+// for a while.
+func (c *Channel) Restore(seq uint64) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	for i := range c.segments {
+		if c.segments[i].seq == seq {
+			c.segments[i].dropped = false
+		}
+	}
+}
+
+// Skip moves the live window n segments past the last one, as if the
+// client fell behind: the listed segments expire and the skipped ones are
+// never listed.
+func (c *Channel) Skip(n int) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.next += uint64(n)
+	c.segments = nil
+}
+
+// Discontinuity marks the next appended segment with EXT-X-DISCONTINUITY.
+func (c *Channel) Discontinuity() {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.discontinuity = true
+}
+
+// SetVariants replaces the variants of the master playlist. Media playlists
+// of removed variants return 404.
+func (c *Channel) SetVariants(variants ...Variant) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.variants = append([]Variant(nil), variants...)
+}
+
+func (c *Channel) Live() bool {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.live
+}
+
+// PlaylistRequests returns how many times media playlists were served.
+func (c *Channel) PlaylistRequests() int {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.playlistRequests
+}
+
+// Fetched returns how many times the segment was requested.
+func (c *Channel) Fetched(seq uint64) int {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.fetched[seq]
+}